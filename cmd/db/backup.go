@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+const backupPrefix = "backup_"
+
+// backupMu keeps the scheduled and requested backups from running at once.
+var backupMu sync.Mutex
+
+// backup makes a checkpoint of db in the backup directory and removes the
+// backups over the number to keep, the oldest first.
+func backup(db *datastore.Db) (string, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	name := backupPrefix + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := db.Checkpoint(path.Join(*backupDir, name)); err != nil {
+		return "", err
+	}
+
+	names, err := listBackups()
+	if err != nil {
+		return name, err
+	}
+	for len(names) > *backupKeep {
+		if err := os.RemoveAll(path.Join(*backupDir, names[0])); err != nil {
+			return name, err
+		}
+		names = names[1:]
+	}
+	return name, nil
+}
+
+// listBackups returns the names of the backups, the oldest first.
+func listBackups() ([]string, error) {
+	files, err := ioutil.ReadDir(*backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if f.IsDir() && strings.HasPrefix(f.Name(), backupPrefix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func backupRoutine(db *datastore.Db, interval time.Duration) {
+	for range time.Tick(interval) {
+		if name, err := backup(db); err != nil {
+			fmt.Printf("backup error: %v\n", err)
+		} else {
+			fmt.Printf("backup %s done\n", name)
+		}
+	}
+}
+
+// backupHandler serves /admin/backup:
+//
+//	GET lists the backups, the oldest first,
+//	POST makes a new one and returns its name.
+func backupHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case "GET":
+			names, err := listBackups()
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(names)
+		case "POST":
+			name, err := backup(db)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(rw).Encode(map[string]string{"name": name})
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// bucketName extracts the bucket from a /db/{bucket}/ path. The default bucket
+// is served at /db/ and has an empty name.
+func bucketName(urlPath string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(urlPath, "/db/"), "/")
+}
+
+// bucketsHandler manages the buckets:
+//
+//	GET /buckets/ lists them,
+//	PUT /buckets/{bucket} creates one,
+//	DELETE /buckets/{bucket} drops one with all its keys,
+//	POST /buckets/{bucket}/compact merges its segments.
+func bucketsHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/buckets/"), "/")
+		if name == "" {
+			if r.Method != "GET" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			names, err := db.ListBuckets()
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if names == nil {
+				names = []string{}
+			}
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(names)
+			return
+		}
+
+		if *leader != "" && r.Method != "GET" {
+			redirectToLeader(rw, r, *leader)
+			return
+		}
+
+		var err error
+		if compacted := strings.TrimSuffix(name, "/compact"); compacted != name && r.Method == "POST" {
+			var bucket *datastore.Db
+			if bucket, err = db.Bucket(compacted); err == nil {
+				err = bucket.Compact()
+			}
+		} else if r.Method == "PUT" {
+			if _, err = db.CreateBucket(name); err == nil {
+				rw.WriteHeader(http.StatusCreated)
+				return
+			}
+		} else if r.Method == "DELETE" {
+			err = db.DropBucket(name)
+		} else {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch err {
+		case nil:
+			rw.WriteHeader(http.StatusOK)
+		case datastore.ErrBucketNotFound:
+			rw.WriteHeader(http.StatusNotFound)
+		case datastore.ErrBucketExists:
+			rw.WriteHeader(http.StatusConflict)
+		case datastore.ErrBucketName:
+			rw.WriteHeader(http.StatusBadRequest)
+		default:
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
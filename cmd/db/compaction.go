@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+type compactionStatus struct {
+	Running bool  `json:"running"`
+	Done    int64 `json:"done"`
+	Total   int64 `json:"total"`
+}
+
+// compactionHandler serves /admin/compaction for the bucket given by the
+// bucket parameter:
+//
+//	GET returns the progress of the running compaction in bytes read,
+//	POST starts a compaction in the background.
+func compactionHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		bucket, err := db.Bucket(r.URL.Query().Get("bucket"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			stats := bucket.Stats()
+			_ = json.NewEncoder(rw).Encode(compactionStatus{stats.Compacting, stats.CompactedBytes, stats.CompactionBytes})
+		case "POST":
+			if *leader != "" {
+				redirectToLeader(rw, r, *leader)
+				return
+			}
+			go func() {
+				if err := bucket.Compact(); err != nil {
+					fmt.Printf("compaction error: %v\n", err)
+				}
+			}()
+			rw.WriteHeader(http.StatusAccepted)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"net/http"
-	"io/ioutil"
+	"os"
+	"time"
 
 	"github.com/FictProger/architecture2-lab-3/datastore"
 	"github.com/FictProger/architecture2-lab-3/httptools"
@@ -21,6 +20,34 @@ type dbRow struct {
 var (
 	port = flag.Int("port", 8090, "server port")
 	dir  = flag.String("dir", ".", "database store directory")
+
+	leader = flag.String("leader", "", "leader address to replicate from, empty for the leader itself")
+
+	cacheSize = flag.Int64("cache-size", 0, "memory budget of the read cache in bytes, 0 to disable")
+	retention = flag.Duration("retention", 0, "how long to keep the old versions of the keys")
+
+	mmapSegments = flag.Bool("mmap", false, "read the segments from their memory mappings")
+	dedup        = flag.Bool("dedup", false, "store the identical large values once")
+
+	slowdownSegments = flag.Int("slowdown-segments", 0, "number of segments that slows the writes down, 0 for no limit")
+	stallSegments    = flag.Int("stall-segments", 0, "number of segments that stalls the writes, 0 for no limit")
+
+	compactionRate  = flag.Int64("compaction-rate", 0, "compaction reads and writes in bytes a second, 0 for no limit")
+	recoveryWorkers = flag.Int("recovery-workers", 0, "number of segments recovered at once on startup, 0 for the number of CPUs")
+
+	readOnly        = flag.Bool("read-only", false, "serve the directory written by another process without writing to it")
+	refreshInterval = flag.Duration("refresh-interval", time.Second, "how often a read-only server re-reads the files")
+
+	maxKeySize   = flag.Int("max-key-size", 0, "maximum key size in bytes, 0 for no limit")
+	maxValueSize = flag.Int64("max-value-size", 0, "maximum value size in bytes, 0 for no limit")
+	diskQuota    = flag.Int64("disk-quota", 0, "maximum size of the data files in bytes, 0 for no limit")
+
+	respPort     = flag.Int("resp-port", 0, "port of the Redis protocol listener, 0 to disable it")
+	memcachePort = flag.Int("memcache-port", 0, "port of the memcached protocol listener, 0 to disable it")
+
+	backupDir      = flag.String("backup-dir", "", "directory of the backups, empty to disable them")
+	backupInterval = flag.Duration("backup-interval", 0, "how often to make a backup, 0 for the requested ones only")
+	backupKeep     = flag.Int("backup-keep", 7, "number of the newest backups to keep")
 )
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
@@ -30,74 +57,86 @@ const dbAddr = "http://db:8070"
 func main() {
 	flag.Parse()
 
-	db, err := datastore.NewDb(*dir, "current-data", false)
+	// The server is started before the Db is opened, so that /ready reports
+	// the recovery; the other handlers are added once it is done.
+	h := new(http.ServeMux)
+	rc := &recovery{}
+	h.HandleFunc("/ready", readyHandler(rc))
+
+	server := httptools.CreateServer(*port, h)
+	server.Start()
+
+	db, err := datastore.NewDbWithOptions(*dir, "current-data", false, datastore.Options{
+		CacheSize:    *cacheSize,
+		Retention:    *retention,
+		MaxKeySize:   *maxKeySize,
+		MaxValueSize: *maxValueSize,
+		DiskQuota:    *diskQuota,
+		MmapSegments: *mmapSegments,
+		Dedup:        *dedup,
+		ReadOnly:     *readOnly,
+
+		SlowdownSegments:   *slowdownSegments,
+		StallSegments:      *stallSegments,
+		CompactionRate:     *compactionRate,
+		RecoveryWorkers:    *recoveryWorkers,
+		OnRecoveryProgress: rc.progress,
+	})
 	if err != nil {
 		fmt.Printf("db run error: %v\n", err)
 		return
 	}
+	if quarantined := db.Stats().Quarantined; quarantined > 0 {
+		fmt.Printf("db runs degraded: %d corrupted files quarantined\n", quarantined)
+	}
 
-	h := new(http.ServeMux)
-
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("Content-Type", "application/json")
-
-		if r.Method == "GET" {
-			key := r.URL.Query().Get("key")
-			if len(key) == 0 {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
-
-			value, err := db.Get(key)
-			if errors.Is(err, datastore.ErrNotFound) || len(value) == 0 {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			} else if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			valueJson, err := json.Marshal(dbRow{key, value})
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			if _, err = rw.Write(valueJson); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			rw.WriteHeader(http.StatusOK)
-		} else if r.Method == "POST" {
-			key := r.URL.Query().Get("key")
-			if len(key) == 0 {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
-
-			body, err := ioutil.ReadAll(r.Body)
-			defer r.Body.Close()
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			var row dbRow
-			if err = json.Unmarshal(body, &row); err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			if err = db.Put(key, row.Value); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			rw.WriteHeader(http.StatusCreated)
+	h.HandleFunc("/db/watch", watchHandler(db))
+	h.HandleFunc("/replication/log", replicationLogHandler(db))
+	h.HandleFunc("/buckets/", bucketsHandler(db))
+	h.HandleFunc("/admin/delete", deleteHandler(db))
+	h.HandleFunc("/admin/compaction", compactionHandler(db))
+	h.HandleFunc("/streams/", streamsHandler(db))
+
+	if *backupDir != "" {
+		// The checkpoints are made in the directory, but not the directory
+		// itself.
+		if err := os.MkdirAll(*backupDir, os.ModePerm); err != nil {
+			fmt.Printf("db run error: %v\n", err)
+			return
 		}
-	})
+		h.HandleFunc("/admin/backup", backupHandler(db))
+		if *backupInterval > 0 {
+			go backupRoutine(db, *backupInterval)
+		}
+	}
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
+	if *leader != "" {
+		go follow(db, *leader)
+	}
+	if *readOnly {
+		go refreshRoutine(db, *refreshInterval)
+	}
+	if writable() {
+		go expiryRoutine(db, time.Second)
+	}
+	if *respPort != 0 {
+		go serveResp(db, *respPort)
+	}
+	if *memcachePort != 0 {
+		go serveMemcache(db, *memcachePort)
+	}
+
+	h.HandleFunc("/db/", keysHandler(db))
+
+	rc.done()
 	signal.WaitForTerminationSignal()
 }
+
+// refreshRoutine picks up the changes made by the writer of a read-only Db.
+func refreshRoutine(db *datastore.Db, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.Refresh(); err != nil {
+			fmt.Printf("refresh error: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+type deleteResult struct {
+	Count  int  `json:"count"`
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// deleteHandler serves POST /admin/delete, which deletes the keys of the bucket
+// given by the bucket parameter either with the prefix parameter or from the
+// start parameter to the end one, exclusive. With dry-run=true it only counts
+// the keys that would be deleted. The response holds the number of keys.
+//
+// An empty prefix or start covers the keys kept by the server, like the
+// deadlines and the streams, and so is refused unless all=true is given;
+// all=true alone deletes the whole bucket.
+func deleteHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		if r.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		dryRun := query.Get("dry-run") == "true"
+		if *leader != "" && !dryRun {
+			redirectToLeader(rw, r, *leader)
+			return
+		}
+
+		bucket, err := db.Bucket(query.Get("bucket"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_, hasPrefix := query["prefix"]
+		_, hasStart := query["start"]
+		if query.Get("all") == "true" {
+			if !hasPrefix && !hasStart {
+				query.Set("prefix", "")
+			}
+		} else if (hasPrefix && query.Get("prefix") == "") || (hasStart && query.Get("start") == "") {
+			writeError(rw, http.StatusBadRequest, errors.New("an empty prefix or start deletes all the keys, all=true is required"))
+			return
+		}
+
+		var (
+			scan     func() ([]string, error)
+			deleteFn func() error
+		)
+		if prefix, ok := query["prefix"]; ok {
+			scan = func() ([]string, error) { return bucket.Scan(prefix[0]) }
+			deleteFn = func() error { return bucket.DeletePrefix(prefix[0]) }
+		} else if _, ok := query["start"]; ok {
+			start, end := query.Get("start"), query.Get("end")
+			scan = func() ([]string, error) { return bucket.ScanRange(start, end) }
+			deleteFn = func() error { return bucket.DeleteRange(start, end) }
+		} else {
+			writeError(rw, http.StatusBadRequest, errors.New("prefix or start is required"))
+			return
+		}
+
+		// The count is taken before the deletion, so it may miss the keys
+		// written in between.
+		keys, err := scan()
+		if err == nil && !dryRun {
+			err = deleteFn()
+		}
+		if err != nil {
+			writePutError(rw, err)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(deleteResult{len(keys), dryRun})
+	}
+}
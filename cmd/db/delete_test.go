@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeleteHandler(t *testing.T) {
+	db := newTestDb(t)
+	for _, key := range []string{"a1", "a2", "b1"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put(expiryPrefix+"a1", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := deleteHandler(db)
+	serve := func(target string) (int, deleteResult) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("POST", target, nil))
+		var result deleteResult
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+				t.Fatalf("%s: bad body %q", target, rw.Body)
+			}
+		}
+		return rw.Code, result
+	}
+
+	for _, target := range []string{
+		"/admin/delete",
+		"/admin/delete?prefix=",
+		"/admin/delete?start=",
+		"/admin/delete?start=&end=b",
+	} {
+		if status, _ := serve(target); status != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status %d", target, status)
+		}
+	}
+
+	if status, result := serve("/admin/delete?prefix=a&dry-run=true"); status != http.StatusOK || result != (deleteResult{2, true}) {
+		t.Errorf("Unexpected dry run %d %v", status, result)
+	}
+	if status, result := serve("/admin/delete?start=a2&end=c"); status != http.StatusOK || result.Count != 2 {
+		t.Errorf("Unexpected range deletion %d %v", status, result)
+	}
+	if status, result := serve("/admin/delete?all=true"); status != http.StatusOK || result.Count != 2 {
+		t.Errorf("Unexpected deletion of all the keys %d %v", status, result)
+	}
+	if keys, err := db.Scan(""); err != nil || len(keys) != 0 {
+		t.Errorf("Unexpected keys %q left, %v", keys, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// expiryPrefix is the prefix of the keys holding the deadlines of the keys
+// given a time to live by the protocol listeners, in Unix milliseconds, and
+// flagsPrefix of the ones holding the client flags of the memcached items
+// when they are not zero. The zero byte keeps them apart from the keys of
+// the clients.
+const (
+	expiryPrefix = "\x00expire\x00"
+	flagsPrefix  = "\x00flags\x00"
+)
+
+// internalKey reports whether the key is kept by the server itself rather
+// than by a client, like the deadlines and the datastore streams.
+func internalKey(key string) bool {
+	return strings.HasPrefix(key, "\x00")
+}
+
+// writable reports whether the server takes writes rather than redirects
+// them to the leader or refuses them.
+func writable() bool {
+	return *leader == "" && !*readOnly
+}
+
+// setExpiry makes the key expire at the deadline.
+func setExpiry(db *datastore.Db, key string, deadline time.Time) error {
+	return db.Put(expiryPrefix+key, formatDeadline(deadline))
+}
+
+func formatDeadline(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func parseDeadline(value string) (time.Time, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, datastore.ErrCorrupted
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// clearMeta drops the deadline and the flags of the key, so that it lives
+// until it is deleted.
+func clearMeta(db *datastore.Db, key string) error {
+	for _, meta := range []string{expiryPrefix + key, flagsPrefix + key} {
+		if _, err := db.Get(meta); errors.Is(err, datastore.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := db.Delete(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiry returns the deadline of the key, the zero time if it has none.
+func expiry(db *datastore.Db, key string) (time.Time, error) {
+	value, err := db.Get(expiryPrefix + key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return parseDeadline(value)
+}
+
+// expired reports whether the deadline of the key has passed. An expired key
+// is deleted by the server that takes writes; the others wait for the
+// deletion to be replicated.
+func expired(db *datastore.Db, key string) (bool, error) {
+	deadline, err := expiry(db, key)
+	if err != nil || deadline.IsZero() || time.Now().Before(deadline) {
+		return false, err
+	}
+
+	if writable() {
+		if err := db.Delete(key); err != nil {
+			return true, err
+		}
+		if err := clearMeta(db, key); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// expiryRoutine deletes the expired keys that nobody reads.
+func expiryRoutine(db *datastore.Db, interval time.Duration) {
+	for range time.Tick(interval) {
+		keys, err := db.Scan(expiryPrefix)
+		if err != nil {
+			fmt.Printf("expiry error: %v\n", err)
+			continue
+		}
+		for _, key := range keys {
+			if _, err := expired(db, strings.TrimPrefix(key, expiryPrefix)); err != nil {
+				fmt.Printf("expiry error: %v\n", err)
+			}
+		}
+	}
+}
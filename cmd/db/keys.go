@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+const allowedKeyMethods = "GET, HEAD, PUT, POST, DELETE"
+
+var errMissingKey = errors.New("missing key")
+
+// keyTarget extracts the bucket and the key of a request to
+//
+//	/db/{key} or /db/{bucket}/{key}, with the URL-encoded bucket and key,
+//	/db/?key={key} or /db/{bucket}/?key={key}, kept for the older clients.
+//
+// A key containing a slash is encoded as %2F in the path. The paths of the
+// other /db/ handlers, like /db/watch, are not taken as keys.
+func keyTarget(r *http.Request) (bucket, key string, err error) {
+	query := r.URL.Query()
+	if _, ok := query["key"]; ok {
+		bucket, key = bucketName(r.URL.Path), query.Get("key")
+	} else {
+		parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"), "/")
+		switch len(parts) {
+		case 1:
+			key = parts[0]
+		case 2:
+			bucket, key = parts[0], parts[1]
+		default:
+			return "", "", fmt.Errorf("bad key path %s", r.URL.Path)
+		}
+		if bucket, err = url.PathUnescape(bucket); err != nil {
+			return "", "", err
+		}
+		if key, err = url.PathUnescape(key); err != nil {
+			return "", "", err
+		}
+	}
+
+	if key == "" {
+		return "", "", errMissingKey
+	}
+	return bucket, key, nil
+}
+
+// keysHandler serves the keys under /db/, as found by keyTarget:
+//
+//	GET returns the JSON row of the key, or the raw value if the Accept
+//	header asks for it, and HEAD only its status,
+//	PUT stores the value of the JSON row or the raw body,
+//	POST stores it too, or runs the operation given by the op parameter,
+//	DELETE deletes the key.
+//
+// The errors are reported as {"error": message}: 400 for a bad request, 404
+// for a missing bucket or key, 405 for another method and 409 for an
+// operation conflicting with the value.
+func keysHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", applicationJson)
+
+		switch r.Method {
+		case "GET", "HEAD", "PUT", "POST", "DELETE":
+		default:
+			rw.Header().Set("Allow", allowedKeyMethods)
+			writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+
+		bucketName, key, err := keyTarget(r)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		bucket, err := db.Bucket(bucketName)
+		if err != nil {
+			writeError(rw, http.StatusNotFound, err)
+			return
+		}
+
+		if *leader != "" && r.Method != "GET" && r.Method != "HEAD" {
+			redirectToLeader(rw, r, *leader)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			// The body of a response to HEAD is dropped by the server.
+			getKey(bucket, key, rw, r)
+		case "PUT":
+			putKey(bucket, key, rw, r)
+		case "POST":
+			if op := r.URL.Query().Get("op"); op != "" {
+				opHandler(bucket, op, key, rw, r)
+				return
+			}
+			putKey(bucket, key, rw, r)
+		case "DELETE":
+			deleteKey(bucket, key, rw)
+		}
+	}
+}
+
+func getKey(bucket *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+	if wantsRaw(r) {
+		getRaw(bucket, key, rw)
+		return
+	}
+
+	value, err := bucket.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(dbRow{key, value})
+}
+
+// putKey stores the value of the request body and responds with 201.
+func putKey(bucket *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+	if isRaw(r) {
+		putRaw(bucket, key, rw, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	var row dbRow
+	if err = json.Unmarshal(body, &row); err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if err = bucket.Put(key, row.Value); err != nil {
+		writePutError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// deleteKey deletes the key and responds with 204, or with 404 if there is
+// no such key. The key is looked up in the same transaction, so that it isn't
+// deleted after another client has deleted and written it again.
+func deleteKey(bucket *datastore.Db, key string, rw http.ResponseWriter) {
+	err := bucket.Update(func(tx *datastore.Tx) error {
+		if _, err := tx.Get(key); err != nil {
+			return err
+		}
+		tx.Delete(key)
+		return nil
+	})
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writePutError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
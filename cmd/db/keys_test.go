@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// newTestDb opens a Db in a temporary directory that is removed with it at
+// the end of the test.
+func newTestDb(t *testing.T) *datastore.Db {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDb(dir, "current-data", false)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return db
+}
+
+func TestKeyTarget(t *testing.T) {
+	for _, tc := range []struct {
+		target      string
+		bucket, key string
+		err         bool
+	}{
+		{target: "/db/key", key: "key"},
+		{target: "/db/users/key", bucket: "users", key: "key"},
+		{target: "/db/a%2Fb", key: "a/b"},
+		{target: "/db/users/a%20b%2F", bucket: "users", key: "a b/"},
+		{target: "/db/?key=a/b", key: "a/b"},
+		{target: "/db/users/?key=key", bucket: "users", key: "key"},
+		{target: "/db/", err: true},
+		{target: "/db/?key=", err: true},
+		{target: "/db/a/b/c", err: true},
+	} {
+		bucket, key, err := keyTarget(httptest.NewRequest("GET", tc.target, nil))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q %q", tc.target, bucket, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.target, err)
+		} else if bucket != tc.bucket || key != tc.key {
+			t.Errorf("%s: unexpected bucket %q and key %q", tc.target, bucket, key)
+		}
+	}
+}
+
+func TestKeysHandler(t *testing.T) {
+	db := newTestDb(t)
+	handler := keysHandler(db)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rw
+	}
+	errorOf := func(rw *httptest.ResponseRecorder) string {
+		var body map[string]string
+		if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Bad error body %q: %v", rw.Body.String(), err)
+		}
+		return body["error"]
+	}
+
+	if rw := serve("PUT", "/db/a%2Fb", `{"value": "text"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected put status %d: %s", rw.Code, rw.Body)
+	}
+	rw := serve("GET", "/db/?key=a/b", "")
+	var row dbRow
+	if rw.Code != http.StatusOK {
+		t.Errorf("Unexpected get status %d", rw.Code)
+	} else if err := json.Unmarshal(rw.Body.Bytes(), &row); err != nil || row != (dbRow{"a/b", "text"}) {
+		t.Errorf("Unexpected row %s", rw.Body)
+	}
+
+	rw = serve("PATCH", "/db/a%2Fb", "")
+	if rw.Code != http.StatusMethodNotAllowed || rw.Header().Get("Allow") != allowedKeyMethods {
+		t.Errorf("Unexpected status %d with Allow %q", rw.Code, rw.Header().Get("Allow"))
+	} else if errorOf(rw) == "" {
+		t.Error("No error message for a method not allowed")
+	}
+
+	rw = serve("GET", "/db/a/b/c", "")
+	if rw.Code != http.StatusBadRequest || errorOf(rw) == "" {
+		t.Errorf("Unexpected status %d for a bad path", rw.Code)
+	}
+	rw = serve("GET", "/db/missing/key", "")
+	if rw.Code != http.StatusNotFound || errorOf(rw) == "" {
+		t.Errorf("Unexpected status %d for a missing bucket", rw.Code)
+	}
+	rw = serve("PUT", "/db/key", "not json")
+	if rw.Code != http.StatusBadRequest || errorOf(rw) == "" {
+		t.Errorf("Unexpected status %d for a bad row", rw.Code)
+	}
+
+	rw = serve("POST", "/db/a%2Fb?op=incr", "")
+	if rw.Code != http.StatusConflict || !strings.Contains(errorOf(rw), datastore.ErrNotNumber.Error()) {
+		t.Errorf("Unexpected status %d for incr of text: %s", rw.Code, rw.Body)
+	}
+	rw = serve("POST", "/db/counter?op=incr&delta=5", "")
+	if err := json.Unmarshal(rw.Body.Bytes(), &row); rw.Code != http.StatusOK || err != nil || row.Value != "5" {
+		t.Errorf("Unexpected incr status %d: %s", rw.Code, rw.Body)
+	}
+
+	if rw = serve("DELETE", "/db/a%2Fb", ""); rw.Code != http.StatusNoContent {
+		t.Errorf("Unexpected delete status %d", rw.Code)
+	}
+	rw = serve("DELETE", "/db/a%2Fb", "")
+	if rw.Code != http.StatusNotFound || errorOf(rw) != datastore.ErrNotFound.Error() {
+		t.Errorf("Unexpected status %d for a deleted key: %s", rw.Code, rw.Body)
+	}
+	rw = serve("GET", "/db/a%2Fb", "")
+	if rw.Code != http.StatusNotFound || errorOf(rw) == "" {
+		t.Errorf("Unexpected status %d for a deleted key", rw.Code)
+	}
+}
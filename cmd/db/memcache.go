@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// mcMaxKeySize and mcMaxItemSize are the limits of the memcached protocol; the
+// datastore limits apply too.
+const (
+	mcMaxKeySize  = 250
+	mcMaxItemSize = 64 * 1024 * 1024
+)
+
+// mcRelativeLimit is the largest exptime taken as seconds from now; a larger
+// one is a Unix time.
+const mcRelativeLimit = 30 * 24 * 60 * 60
+
+var errNotStored = errors.New("NOT_STORED")
+
+type mcStats struct {
+	start                        time.Time
+	currConnections, connections int64
+	gets, sets, hits, misses     int64
+}
+
+// serveMemcache serves the memcached clients on the port with the ASCII
+// protocol commands
+//
+//	get, gets, set, add, replace, cas, delete, incr, decr, stats and quit
+//
+// on the default bucket. The exptime of an item is its time to live, as
+// with the EXPIRE of the Redis listener, and its cas value is the version of
+// the key, which is kept in memory, mixed with mcEpoch: like in memcached,
+// the values taken before a restart are not valid after it.
+func serveMemcache(db *datastore.Db, port int) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fmt.Printf("memcache listener error: %v\n", err)
+		return
+	}
+	stats := &mcStats{start: time.Now()}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("memcache listener error: %v\n", err)
+			return
+		}
+		go handleMemcache(db, stats, conn)
+	}
+}
+
+func handleMemcache(db *datastore.Db, stats *mcStats, conn net.Conn) {
+	atomic.AddInt64(&stats.currConnections, 1)
+	atomic.AddInt64(&stats.connections, 1)
+	defer atomic.AddInt64(&stats.currConnections, -1)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readRespLine(r)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if args[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := runMemcacheCommand(db, stats, r, w, args); err != nil {
+			// The connection is out of step with the client after a
+			// broken data block.
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// runMemcacheCommand runs the command and writes its reply. It returns an
+// error if the connection can't go on.
+func runMemcacheCommand(db *datastore.Db, stats *mcStats, r *bufio.Reader, w *bufio.Writer, args []string) error {
+	reply := func(s string) {
+		fmt.Fprintf(w, "%s\r\n", s)
+	}
+	// A lone noreply is a command name, an unknown one.
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+		reply = func(string) {}
+	}
+
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return nil
+		}
+		for _, key := range args[1:] {
+			atomic.AddInt64(&stats.gets, 1)
+			value, flags, version, err := getItem(db, key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				atomic.AddInt64(&stats.misses, 1)
+				continue
+			} else if err != nil {
+				fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+				return nil
+			}
+			atomic.AddInt64(&stats.hits, 1)
+			if args[0] == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, flags, len(value), version, value)
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n%s\r\n", key, flags, len(value), value)
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+	case "set", "add", "replace", "cas":
+		return storeCommand(db, stats, r, w, args, reply)
+	case "delete":
+		if len(args) != 2 || !mcValidKey(args[1]) {
+			fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		if !writable() {
+			fmt.Fprintf(w, "SERVER_ERROR %v\r\n", datastore.ErrReadOnly)
+			return nil
+		}
+		key := args[1]
+		err := db.Update(func(tx *datastore.Tx) error {
+			if _, _, _, err := loadItem(tx.GetVersion, key); err != nil {
+				return err
+			}
+			tx.Delete(key)
+			return dropItemMeta(tx, key)
+		})
+		if errors.Is(err, datastore.ErrNotFound) {
+			reply("NOT_FOUND")
+		} else if err != nil {
+			fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+		} else {
+			reply("DELETED")
+		}
+	case "incr", "decr":
+		if len(args) != 3 || !mcValidKey(args[1]) {
+			fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			fmt.Fprint(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+		if !writable() {
+			fmt.Fprintf(w, "SERVER_ERROR %v\r\n", datastore.ErrReadOnly)
+			return nil
+		}
+		key := args[1]
+		var n uint64
+		err = db.Update(func(tx *datastore.Tx) error {
+			value, _, _, err := loadItem(tx.GetVersion, key)
+			if err != nil {
+				return err
+			}
+			if n, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return datastore.ErrNotNumber
+			}
+			// incr wraps around at 64 bits and decr stops at 0, as in
+			// memcached.
+			if args[0] == "incr" {
+				n += delta
+			} else if n > delta {
+				n -= delta
+			} else {
+				n = 0
+			}
+			tx.Put(key, strconv.FormatUint(n, 10))
+			return nil
+		})
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			reply("NOT_FOUND")
+		case errors.Is(err, datastore.ErrNotNumber):
+			fmt.Fprint(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		case err != nil:
+			fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+		default:
+			reply(strconv.FormatUint(n, 10))
+		}
+	case "stats":
+		writeMemcacheStats(db, stats, w)
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return nil
+}
+
+// storeCommand runs set, add, replace and cas, which are followed by a data
+// block:
+//
+//	<command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func storeCommand(db *datastore.Db, stats *mcStats, r *bufio.Reader, w *bufio.Writer, args []string, reply func(string)) error {
+	command := args[0]
+	want := 5
+	if command == "cas" {
+		want = 6
+	}
+	if len(args) != want {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 || size > mcMaxItemSize {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return errors.New("bad data chunk")
+	}
+	atomic.AddInt64(&stats.sets, 1)
+
+	key, value := args[1], string(data[:size])
+	flags, err := strconv.ParseUint(args[2], 10, 32)
+	exptime, expErr := strconv.ParseInt(args[3], 10, 64)
+	var unique uint64
+	if command == "cas" && err == nil {
+		unique, err = strconv.ParseUint(args[5], 10, 64)
+	}
+	if err != nil || expErr != nil || !mcValidKey(key) {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	if !writable() {
+		fmt.Fprintf(w, "SERVER_ERROR %v\r\n", datastore.ErrReadOnly)
+		return nil
+	}
+
+	err = db.Update(func(tx *datastore.Tx) error {
+		_, _, version, err := loadItem(tx.GetVersion, key)
+		found := err == nil
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+		switch {
+		case command == "add" && found, command == "replace" && !found:
+			return errNotStored
+		case command == "cas" && !found:
+			return datastore.ErrNotFound
+		case command == "cas" && version != unique:
+			return datastore.ErrConflict
+		}
+		return storeItem(tx, key, value, uint32(flags), mcDeadline(exptime))
+	})
+	switch {
+	case errors.Is(err, errNotStored):
+		reply("NOT_STORED")
+	case errors.Is(err, datastore.ErrNotFound):
+		reply("NOT_FOUND")
+	case errors.Is(err, datastore.ErrConflict):
+		reply("EXISTS")
+	case err != nil:
+		fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+	default:
+		reply("STORED")
+	}
+	return nil
+}
+
+func mcValidKey(key string) bool {
+	if key == "" || len(key) > mcMaxKeySize || internalKey(key) {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// mcDeadline returns the deadline of the exptime: none for 0, seconds from
+// now up to mcRelativeLimit and a Unix time above it. A negative exptime
+// expires the item at once.
+func mcDeadline(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime <= mcRelativeLimit:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// mcEpoch is the start time of the server in the high bits of the cas values.
+// The versions of the keys start over on a restart while the values stay, so
+// a cas value taken before the restart would match another value after it.
+var mcEpoch = uint64(time.Now().Unix()) << 32
+
+// getItem reads the value, the flags and the version of the item outside of
+// a transaction.
+func getItem(db *datastore.Db, key string) (string, uint32, uint64, error) {
+	if gone, err := expired(db, key); err != nil {
+		return "", 0, 0, err
+	} else if gone {
+		return "", 0, 0, datastore.ErrNotFound
+	}
+	return loadItem(db.GetVersion, key)
+}
+
+// loadItem reads the item with get, which is either Db.GetVersion or a
+// Tx.GetVersion, and returns its value, flags and cas value. An expired item
+// is reported as ErrNotFound.
+func loadItem(get func(key string) (string, uint64, error), key string) (string, uint32, uint64, error) {
+	value, version, err := get(key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	if deadline, _, err := get(expiryPrefix + key); err == nil {
+		if at, err := parseDeadline(deadline); err != nil {
+			return "", 0, 0, err
+		} else if !time.Now().Before(at) {
+			return "", 0, 0, datastore.ErrNotFound
+		}
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return "", 0, 0, err
+	}
+
+	var flags uint64
+	if param, _, err := get(flagsPrefix + key); err == nil {
+		if flags, err = strconv.ParseUint(param, 10, 32); err != nil {
+			return "", 0, 0, datastore.ErrCorrupted
+		}
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return "", 0, 0, err
+	}
+	return value, uint32(flags), mcEpoch + version, nil
+}
+
+// storeItem writes the item in the transaction, replacing the flags and the
+// deadline of the old one.
+func storeItem(tx *datastore.Tx, key, value string, flags uint32, deadline time.Time) error {
+	if err := dropItemMeta(tx, key); err != nil {
+		return err
+	}
+	tx.Put(key, value)
+	if flags != 0 {
+		tx.Put(flagsPrefix+key, strconv.FormatUint(uint64(flags), 10))
+	}
+	if !deadline.IsZero() {
+		tx.Put(expiryPrefix+key, formatDeadline(deadline))
+	}
+	return nil
+}
+
+// dropItemMeta deletes the flags and the deadline of the item in the
+// transaction.
+func dropItemMeta(tx *datastore.Tx, key string) error {
+	for _, meta := range []string{flagsPrefix + key, expiryPrefix + key} {
+		if _, err := tx.Get(meta); err == nil {
+			tx.Delete(meta)
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMemcacheStats(db *datastore.Db, stats *mcStats, w *bufio.Writer) {
+	dbStats := db.Stats()
+	now := time.Now()
+	for _, stat := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(stats.start) / time.Second)},
+		{"time", now.Unix()},
+		{"curr_connections", atomic.LoadInt64(&stats.currConnections)},
+		{"total_connections", atomic.LoadInt64(&stats.connections)},
+		{"cmd_get", atomic.LoadInt64(&stats.gets)},
+		{"cmd_set", atomic.LoadInt64(&stats.sets)},
+		{"get_hits", atomic.LoadInt64(&stats.hits)},
+		{"get_misses", atomic.LoadInt64(&stats.misses)},
+		{"segments", dbStats.Segments},
+		{"disk_usage", dbStats.DiskUsage},
+		{"cache_size", dbStats.CacheSize},
+	} {
+		fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	fmt.Fprint(w, "END\r\n")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcache(t *testing.T) {
+	db := newTestDb(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMemcache(db, &mcStats{start: time.Now()}, server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(client)
+	// send writes the command and returns the lines of the reply, up to the
+	// line that ends it.
+	send := func(command string, last func(line string) bool) []string {
+		if _, err := client.Write([]byte(command)); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for {
+			line, err := readRespLine(r)
+			if err != nil {
+				t.Fatalf("%q: %v", command, err)
+			}
+			lines = append(lines, line)
+			if last(line) {
+				return lines
+			}
+		}
+	}
+	one := func(string) bool { return true }
+	end := func(line string) bool { return line == "END" }
+	expect := func(command string, reply ...string) {
+		last := one
+		if reply[len(reply)-1] == "END" {
+			last = end
+		}
+		if lines := send(command, last); strings.Join(lines, "|") != strings.Join(reply, "|") {
+			t.Errorf("%q: unexpected reply %q", command, lines)
+		}
+	}
+
+	expect("set key 5 0 5\r\nvalue\r\n", "STORED")
+	expect("get key missing\r\n", "VALUE key 5 5", "value", "END")
+	expect("add key 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("replace missing 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect("set key 0 0 abc\r\n", "CLIENT_ERROR bad command line format")
+	expect("set key 0 0\r\n", "CLIENT_ERROR bad command line format")
+	expect("bogus\r\n", "ERROR")
+	expect("noreply\r\n", "ERROR")
+
+	lines := send("gets key\r\n", end)
+	var flags, size int
+	var unique uint64
+	if len(lines) != 3 {
+		t.Fatalf("Unexpected gets reply %q", lines)
+	}
+	if _, err := fmt.Sscanf(lines[0], "VALUE key %d %d %d", &flags, &size, &unique); err != nil {
+		t.Fatalf("Unexpected gets line %q: %v", lines[0], err)
+	}
+	if unique>>32 != mcEpoch>>32 {
+		t.Errorf("No start time in the cas value %d", unique)
+	}
+	expect(fmt.Sprintf("cas key 0 0 3 %d\r\nnew\r\n", unique), "STORED")
+	expect(fmt.Sprintf("cas key 0 0 3 %d\r\nold\r\n", unique), "EXISTS")
+	expect("cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND")
+	expect("get key\r\n", "VALUE key 0 3", "new", "END")
+
+	expect("set counter 0 0 2\r\n10\r\n", "STORED")
+	expect("incr counter 5\r\n", "15")
+	expect("decr counter 20\r\n", "0")
+	expect("incr key 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	expect("delete key\r\n", "DELETED")
+	expect("delete key\r\n", "NOT_FOUND")
+
+	// The noreply commands are answered by the next one only.
+	expect("set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", "VALUE quiet 0 1", "q", "END")
+	// A data block of a wrong size closes the connection.
+	expect("set key 0 0 1\r\nxx\r\n", "CLIENT_ERROR bad data chunk")
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("The connection is open after a bad data chunk")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// opHandler runs an atomic operation on the key, chosen by the op parameter
+// of POST /db/{key}?op={op}:
+//
+//	incr adds the delta parameter, 1 by default, to an integer value,
+//	append adds the value of the JSON row in the body to the end of the value.
+//
+// Both respond with the new row; the row of append is read after the
+// operation, so it may include a later write. A non-integer value for incr is a conflict.
+func opHandler(bucket *datastore.Db, op, key string, rw http.ResponseWriter, r *http.Request) {
+	var (
+		value string
+		err   error
+	)
+	switch op {
+	case "incr":
+		delta := int64(1)
+		if param := r.URL.Query().Get("delta"); param != "" {
+			if delta, err = strconv.ParseInt(param, 10, 64); err != nil {
+				writeError(rw, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var n int64
+		n, err = bucket.Incr(key, delta)
+		value = strconv.FormatInt(n, 10)
+	case "append":
+		body, readErr := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		var row dbRow
+		if readErr != nil || json.Unmarshal(body, &row) != nil {
+			writeError(rw, http.StatusBadRequest, errors.New("bad row"))
+			return
+		}
+		if err = bucket.Append(key, row.Value); err == nil {
+			value, err = bucket.Get(key)
+		}
+	default:
+		writeError(rw, http.StatusBadRequest, errors.New("unknown operation "+op))
+		return
+	}
+
+	if errors.Is(err, datastore.ErrNotNumber) {
+		writeError(rw, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writePutError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(dbRow{key, value})
+}
+
+// writeError responds with the status and the error message in JSON.
+func writeError(rw http.ResponseWriter, status int, err error) {
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
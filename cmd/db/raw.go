@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+const (
+	applicationJson = "application/json"
+	octetStream     = "application/octet-stream"
+)
+
+// isRaw reports whether the request body holds a raw value rather than a JSON
+// row. A body without a content type or with the form type, which curl and
+// similar tools send by default, is treated as JSON.
+func isRaw(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return mediaType != applicationJson && mediaType != "application/x-www-form-urlencoded"
+}
+
+// wantsRaw reports whether the client asks for the raw value. JSON is returned
+// unless the Accept header excludes it.
+func wantsRaw(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	return !strings.Contains(accept, applicationJson) && !strings.Contains(accept, "*/*")
+}
+
+// getRaw writes the raw value of the key to the response without loading
+// it into memory.
+func getRaw(db *datastore.Db, key string, rw http.ResponseWriter) {
+	value, err := db.GetStream(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeError(rw, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	defer value.Close()
+
+	rw.Header().Set("Content-Type", octetStream)
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(rw, value)
+}
+
+// stallRetryAfter is the Retry-After of a response to a stalled write, in
+// seconds.
+const stallRetryAfter = 1
+
+// putErrorStatus returns the response status for a failed put: a read-only
+// Db is forbidden to write, a key or a value over the limit is too large,
+// a put over the quota is out of storage, and a stalled write is unavailable.
+func putErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, datastore.ErrWriteStall):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writePutError writes the status and the error of a failed put, telling a
+// stalled client when to retry.
+func writePutError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, datastore.ErrWriteStall) {
+		rw.Header().Set("Retry-After", strconv.Itoa(stallRetryAfter))
+	}
+	writeError(rw, putErrorStatus(err), err)
+}
+
+// putRaw stores the raw request body as the value of the key. A body of a
+// known size is streamed to the disk, other bodies are read into memory.
+func putRaw(db *datastore.Db, key string, rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var err error
+	if r.ContentLength >= 0 {
+		err = db.PutStream(key, r.Body, r.ContentLength)
+	} else {
+		body := io.Reader(r.Body)
+		if *maxValueSize > 0 {
+			// The body over the limit is not read into memory.
+			body = io.LimitReader(body, *maxValueSize+1)
+		}
+		var value []byte
+		if value, err = ioutil.ReadAll(body); err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		err = db.PutBytes([]byte(key), value)
+	}
+	if err != nil {
+		writePutError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
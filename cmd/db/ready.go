@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// recovery tracks the opening of the Db, which recovers the segments before
+// the requests can be served.
+type recovery struct {
+	sync.Mutex
+	recovered, total int
+	ready            bool
+}
+
+func (rc *recovery) progress(recovered, total int) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.recovered, rc.total = recovered, total
+}
+
+func (rc *recovery) done() {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.ready = true
+}
+
+type readiness struct {
+	Ready             bool `json:"ready"`
+	RecoveredSegments int  `json:"recoveredSegments"`
+	TotalSegments     int  `json:"totalSegments"`
+}
+
+// readyHandler serves /ready, which fails with 503 until the Db is opened.
+func readyHandler(rc *recovery) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rc.Lock()
+		res := readiness{rc.ready, rc.recovered, rc.total}
+		rc.Unlock()
+
+		rw.Header().Set("Content-Type", "application/json")
+		if !res.Ready {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(res)
+	}
+}
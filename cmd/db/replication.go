@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+const (
+	replicationBatchSize  = 1024 * 1024
+	replicationWaitTime   = 5 * time.Second
+	replicationRetryDelay = 1 * time.Second
+
+	logSegmentHeader    = "X-Log-Segment"
+	logGenerationHeader = "X-Log-Generation"
+	logOffsetHeader     = "X-Log-Offset"
+
+	// positionFile keeps the position in the leader log of the default
+	// bucket applied by a follower, in the directory of the Db, and
+	// positionFile.{bucket} the ones of the other buckets, so that a
+	// restarted follower resumes from it instead of replaying the whole log.
+	positionFile = "replication-position"
+)
+
+// replicationLogHandler serves the records of the leader log of the bucket
+// parameter, the default bucket if it is empty, starting from the position in
+// the segment, generation and offset parameters; the generation may be left
+// out for the first generation of a segment. If there are no new records the
+// request waits for a write for up to replicationWaitTime.
+// The position to continue from is returned in the response headers.
+func replicationLogHandler(root *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			pos datastore.LogPosition
+			err error
+		)
+		query := r.URL.Query()
+		db, err := root.Bucket(query.Get("bucket"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if pos.Segment, err = strconv.ParseInt(query.Get("segment"), 10, 64); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if generation := query.Get("generation"); generation != "" {
+			if pos.Generation, err = strconv.ParseInt(generation, 10, 64); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if pos.Offset, err = strconv.ParseInt(query.Get("offset"), 10, 64); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Subscribe before reading, so that a write made in between still
+		// wakes the request up.
+		events, cancel := db.Watch("")
+		defer cancel()
+
+		records, next, err := db.ReadLog(pos, replicationBatchSize)
+		if err == nil && len(records) == 0 {
+			select {
+			case <-events:
+			case <-time.After(replicationWaitTime):
+			case <-r.Context().Done():
+				return
+			}
+			records, next, err = db.ReadLog(pos, replicationBatchSize)
+		}
+		if err != nil {
+			log.Printf("Cannot read the log from %d:%d: %s", pos.Segment, pos.Offset, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set(logSegmentHeader, strconv.FormatInt(next.Segment, 10))
+		rw.Header().Set(logGenerationHeader, strconv.FormatInt(next.Generation, 10))
+		rw.Header().Set(logOffsetHeader, strconv.FormatInt(next.Offset, 10))
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write(records)
+	}
+}
+
+// follow replicates the leader logs of the default bucket and of the other
+// buckets into db forever, reconnecting on errors and resuming from the last
+// applied position.
+func follow(db *datastore.Db, leaderAddr string) {
+	go followBuckets(db, leaderAddr)
+	followBucket(db, leaderAddr, "")
+}
+
+// followBuckets creates the buckets of the leader in db and replicates every
+// one of them. The list of the buckets is checked every replicationWaitTime.
+// A bucket dropped by the leader is dropped in db too.
+func followBuckets(db *datastore.Db, leaderAddr string) {
+	client := http.Client{
+		Timeout: replicationWaitTime,
+	}
+
+	dropped := make(chan string)
+	followed := make(map[string]bool)
+	for {
+		names, err := leaderBuckets(&client, leaderAddr)
+		if err != nil {
+			log.Printf("Cannot list the buckets of %s: %s", leaderAddr, err)
+		}
+		for _, name := range names {
+			if followed[name] {
+				continue
+			}
+			bucket, err := db.Bucket(name)
+			if err == datastore.ErrBucketNotFound {
+				// The position left by a bucket dropped before is not
+				// valid for the new one.
+				if err = removePosition(name); err == nil {
+					bucket, err = db.CreateBucket(name)
+				}
+			}
+			if err != nil {
+				log.Printf("Cannot create the bucket %s: %s", name, err)
+				continue
+			}
+
+			followed[name] = true
+			go func(name string) {
+				followBucket(bucket, leaderAddr, name)
+				if err := db.DropBucket(name); err != nil {
+					log.Printf("Cannot drop the bucket %s: %s", name, err)
+				} else if err := removePosition(name); err != nil {
+					log.Printf("Cannot remove the replication position of %s: %s", name, err)
+				}
+				dropped <- name
+			}(name)
+		}
+
+		timeout := time.After(replicationWaitTime)
+	wait:
+		for {
+			select {
+			case name := <-dropped:
+				delete(followed, name)
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+}
+
+// leaderBuckets returns the names of the buckets of the leader.
+func leaderBuckets(client *http.Client, leaderAddr string) ([]string, error) {
+	resp, err := client.Get(leaderAddr + "/buckets/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var names []string
+	err = json.NewDecoder(resp.Body).Decode(&names)
+	return names, err
+}
+
+// followBucket replicates the leader log of the bucket into db until the
+// leader drops the bucket, starting from the saved position. The position is
+// saved after the records are applied, so a crash in between only applies
+// them again.
+func followBucket(db *datastore.Db, leaderAddr, bucket string) {
+	client := http.Client{
+		Timeout: replicationWaitTime + 5*time.Second,
+	}
+
+	pos, err := loadPosition(bucket)
+	if err != nil {
+		log.Printf("Cannot read the replication position of %q, replicating from the start: %s", bucket, err)
+	}
+	for {
+		next, err := pullLog(&client, db, leaderAddr, bucket, pos)
+		if err == errBucketDropped {
+			return
+		} else if err != nil {
+			log.Printf("Replication of %q from %s failed at %d:%d: %s", bucket, leaderAddr, pos.Segment, pos.Offset, err)
+			time.Sleep(replicationRetryDelay)
+			continue
+		}
+		if next != pos {
+			if err := savePosition(bucket, next); err != nil {
+				log.Printf("Cannot save the replication position of %q: %s", bucket, err)
+			}
+		}
+		pos = next
+	}
+}
+
+func positionPath(bucket string) string {
+	if bucket == "" {
+		return filepath.Join(*dir, positionFile)
+	}
+	return filepath.Join(*dir, positionFile+"."+bucket)
+}
+
+// loadPosition returns the saved position of the bucket, the start of the log
+// if there is none.
+func loadPosition(bucket string) (datastore.LogPosition, error) {
+	var pos datastore.LogPosition
+	data, err := ioutil.ReadFile(positionPath(bucket))
+	if os.IsNotExist(err) {
+		return pos, nil
+	} else if err != nil {
+		return pos, err
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d %d", &pos.Segment, &pos.Generation, &pos.Offset); err != nil {
+		return datastore.LogPosition{}, err
+	}
+	return pos, nil
+}
+
+// savePosition writes the position of the bucket to a temporary file that
+// replaces the old one, so that a crash never leaves half of it.
+func savePosition(bucket string, pos datastore.LogPosition) error {
+	name := positionPath(bucket)
+	data := fmt.Sprintf("%d %d %d\n", pos.Segment, pos.Generation, pos.Offset)
+	if err := ioutil.WriteFile(name+".tmp", []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func removePosition(bucket string) error {
+	if err := os.Remove(positionPath(bucket)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var errBucketDropped = errors.New("bucket is dropped")
+
+func pullLog(client *http.Client, db *datastore.Db, leaderAddr, bucket string, pos datastore.LogPosition) (datastore.LogPosition, error) {
+	query := url.Values{}
+	if bucket != "" {
+		query.Set("bucket", bucket)
+	}
+	query.Set("segment", strconv.FormatInt(pos.Segment, 10))
+	query.Set("generation", strconv.FormatInt(pos.Generation, 10))
+	query.Set("offset", strconv.FormatInt(pos.Offset, 10))
+	resp, err := client.Get(leaderAddr + "/replication/log?" + query.Encode())
+	if err != nil {
+		return pos, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && bucket != "" {
+		return pos, errBucketDropped
+	} else if resp.StatusCode != http.StatusOK {
+		return pos, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var next datastore.LogPosition
+	if next.Segment, err = strconv.ParseInt(resp.Header.Get(logSegmentHeader), 10, 64); err != nil {
+		return pos, err
+	}
+	if next.Generation, err = strconv.ParseInt(resp.Header.Get(logGenerationHeader), 10, 64); err != nil {
+		return pos, err
+	}
+	if next.Offset, err = strconv.ParseInt(resp.Header.Get(logOffsetHeader), 10, 64); err != nil {
+		return pos, err
+	}
+
+	records, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return pos, err
+	}
+	if err := db.ApplyLog(records); err != nil {
+		return pos, err
+	}
+	return next, nil
+}
+
+// redirectToLeader sends a write made to a follower to the leader. The 307
+// status keeps the method and the body of the request.
+func redirectToLeader(rw http.ResponseWriter, r *http.Request, leaderAddr string) {
+	http.Redirect(rw, r, leaderAddr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+// maxBulkSize is the largest bulk string taken from a client, as in Redis.
+const maxBulkSize = 512 * 1024 * 1024
+
+// respScanCount is the number of keys SCAN looks at without COUNT.
+const respScanCount = 10
+
+var errRespProtocol = errors.New("Protocol error")
+
+// serveResp serves the Redis clients on the port with a subset of RESP2:
+//
+//	GET key, SET key value [EX seconds|PX milliseconds], DEL key..., EXISTS key...,
+//	INCR key, SCAN cursor [MATCH pattern] [COUNT count], EXPIRE key seconds,
+//	PING [message] and INFO.
+//
+// The commands run on the default bucket. The keys starting with a zero byte
+// are kept by the server and can't be used.
+func serveResp(db *datastore.Db, port int) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fmt.Printf("resp listener error: %v\n", err)
+		return
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("resp listener error: %v\n", err)
+			return
+		}
+		go handleResp(db, conn)
+	}
+}
+
+func handleResp(db *datastore.Db, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := &respWriter{bufio.NewWriter(conn)}
+
+	for {
+		args, err := readRespCommand(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			w.error("ERR " + err.Error())
+			w.Flush()
+			return
+		}
+		if len(args) > 0 {
+			if strings.ToUpper(args[0]) == "QUIT" {
+				w.status("OK")
+				w.Flush()
+				return
+			}
+			runRespCommand(db, w, args)
+		}
+		// The replies to the pipelined commands are sent together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRespCommand reads an array of bulk strings, or an inline command
+// separated by spaces as typed in telnet.
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1024*1024 {
+		return nil, errRespProtocol
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errRespProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, errRespProtocol
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if string(arg[size:]) != "\r\n" {
+			return nil, errRespProtocol
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func readRespLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if line != "" && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// respWriter writes the RESP2 replies.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) status(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w *respWriter) error(s string) {
+	fmt.Fprintf(w, "-%s\r\n", strings.ReplaceAll(s, "\r\n", " "))
+}
+
+func (w *respWriter) integer(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w *respWriter) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) array(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// writeError writes the error of a write the way Redis reports the same
+// causes.
+func (w *respWriter) writeError(err error) {
+	switch {
+	case errors.Is(err, datastore.ErrReadOnly):
+		w.error("READONLY You can't write against a read only replica.")
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		w.error("OOM " + err.Error())
+	case errors.Is(err, datastore.ErrWriteStall):
+		w.error("BUSY " + err.Error())
+	default:
+		w.error("ERR " + err.Error())
+	}
+}
+
+// respArity holds the least number of arguments of every command, counting
+// the name, negative for the commands that take more.
+var respArity = map[string]int{
+	"PING":   -1,
+	"GET":    2,
+	"SET":    -3,
+	"DEL":    -2,
+	"EXISTS": -2,
+	"INCR":   2,
+	"SCAN":   -2,
+	"EXPIRE": 3,
+	"INFO":   -1,
+}
+
+var respWrites = map[string]bool{"SET": true, "DEL": true, "INCR": true, "EXPIRE": true}
+
+func runRespCommand(db *datastore.Db, w *respWriter, args []string) {
+	name := strings.ToUpper(args[0])
+	arity, ok := respArity[name]
+	if !ok {
+		w.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (arity > 0 && len(args) != arity) || (arity < 0 && len(args) < -arity) {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	keys := args[1:]
+	switch name {
+	case "PING", "SCAN", "INFO":
+		keys = nil
+	case "GET", "SET", "INCR", "EXPIRE":
+		keys = args[1:2]
+	}
+	for _, key := range keys {
+		if internalKey(key) {
+			w.error("ERR keys starting with a zero byte are reserved")
+			return
+		}
+	}
+	if respWrites[name] && !writable() {
+		w.writeError(datastore.ErrReadOnly)
+		return
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			w.bulk(args[1])
+		} else {
+			w.status("PONG")
+		}
+	case "GET":
+		value, err := respGet(db, args[1])
+		if errors.Is(err, datastore.ErrNotFound) {
+			w.null()
+		} else if err != nil {
+			w.error("ERR " + err.Error())
+		} else {
+			w.bulk(value)
+		}
+	case "SET":
+		respSet(db, w, args[1:])
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if _, err := respGet(db, key); errors.Is(err, datastore.ErrNotFound) {
+				continue
+			} else if err != nil {
+				w.error("ERR " + err.Error())
+				return
+			}
+			if err := db.Delete(key); err != nil {
+				w.writeError(err)
+				return
+			}
+			if err := clearMeta(db, key); err != nil {
+				w.writeError(err)
+				return
+			}
+			n++
+		}
+		w.integer(n)
+	case "EXISTS":
+		var n int64
+		for _, key := range args[1:] {
+			if _, err := respGet(db, key); err == nil {
+				n++
+			} else if !errors.Is(err, datastore.ErrNotFound) {
+				w.error("ERR " + err.Error())
+				return
+			}
+		}
+		w.integer(n)
+	case "INCR":
+		if _, err := expired(db, args[1]); err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		n, err := db.Incr(args[1], 1)
+		if errors.Is(err, datastore.ErrNotNumber) {
+			w.error("ERR value is not an integer or out of range")
+		} else if err != nil {
+			w.writeError(err)
+		} else {
+			w.integer(n)
+		}
+	case "SCAN":
+		respScan(db, w, args[1:])
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			w.error("ERR value is not an integer or out of range")
+			return
+		}
+		if _, err := respGet(db, args[1]); errors.Is(err, datastore.ErrNotFound) {
+			w.integer(0)
+			return
+		} else if err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		if seconds <= 0 {
+			err = db.Delete(args[1])
+			if err == nil {
+				err = clearMeta(db, args[1])
+			}
+		} else {
+			err = setExpiry(db, args[1], time.Now().Add(time.Duration(seconds)*time.Second))
+		}
+		if err != nil {
+			w.writeError(err)
+			return
+		}
+		w.integer(1)
+	case "INFO":
+		w.bulk(respInfo(db))
+	}
+}
+
+// respGet returns the value of the key unless it has expired.
+func respGet(db *datastore.Db, key string) (string, error) {
+	if gone, err := expired(db, key); err != nil {
+		return "", err
+	} else if gone {
+		return "", datastore.ErrNotFound
+	}
+	return db.Get(key)
+}
+
+func respSet(db *datastore.Db, w *respWriter, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if (option != "EX" && option != "PX") || ttl != 0 || i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		if option == "EX" {
+			ttl = time.Duration(n) * time.Second
+		} else {
+			ttl = time.Duration(n) * time.Millisecond
+		}
+		i++
+	}
+
+	// A new value drops the time to live of the old one. The value and its
+	// deadline are written together, so a key is never left with the
+	// deadline of another value.
+	var deadline time.Time
+	if ttl > 0 {
+		deadline = time.Now().Add(ttl)
+	}
+	err := db.Update(func(tx *datastore.Tx) error {
+		return storeItem(tx, key, value, 0, deadline)
+	})
+	if err != nil {
+		w.writeError(err)
+		return
+	}
+	w.status("OK")
+}
+
+// respScan walks the sorted keys; the cursor encodes the next key to look at,
+// as a number since the clients parse it as one. Like in Redis, a key added
+// or deleted during the walk may be missed, and MATCH is applied after COUNT
+// keys are taken.
+func respScan(db *datastore.Db, w *respWriter, args []string) {
+	start, ok := parseScanCursor(args[0])
+	if !ok {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", respScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		var err error
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	// One key more than asked for is the start of the next page.
+	page, err := db.ScanLimit(start, "", count+1)
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	next := "0"
+	if len(page) > count {
+		next = formatScanCursor(page[count])
+		page = page[:count]
+	}
+
+	var keys []string
+	for _, key := range page {
+		if !matchGlob(pattern, key) {
+			continue
+		}
+		if gone, err := expired(db, key); err != nil {
+			w.error("ERR " + err.Error())
+			return
+		} else if !gone {
+			keys = append(keys, key)
+		}
+	}
+
+	w.array(2)
+	w.bulk(next)
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// firstClientKey is the least key a client can use: the keys of the server
+// start with a zero byte and sort before it.
+const firstClientKey = "\x01"
+
+// formatScanCursor encodes the key as the decimal number of its bytes, after
+// a one byte that keeps the zero bytes in front of the key.
+func formatScanCursor(key string) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// parseScanCursor decodes the key of formatScanCursor, and the first client
+// key from the cursor 0.
+func parseScanCursor(cursor string) (string, bool) {
+	n, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || n.Sign() < 0 {
+		return "", false
+	}
+	if n.Sign() == 0 {
+		return firstClientKey, true
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return "", false
+	}
+	if key := string(b[1:]); key >= firstClientKey {
+		return key, true
+	}
+	return "", false
+}
+
+// matchGlob reports whether s matches the Redis glob pattern with *, ?,
+// [...] classes and \ escapes.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			if s == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			if matchClass(class, s[0]) == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func matchClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				return true
+			}
+			i += 2
+		} else if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// respInfo describes the server in the INFO format.
+func respInfo(db *datastore.Db) string {
+	role := "master"
+	if !writable() {
+		role = "slave"
+	}
+	stats := db.Stats()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Server\r\nredis_mode:standalone\r\ntcp_port:%d\r\n\r\n", *respPort)
+	fmt.Fprintf(&b, "# Replication\r\nrole:%s\r\n\r\n", role)
+	fmt.Fprintf(&b, "# Persistence\r\nsegments:%d\r\ncurrent_size:%d\r\ndisk_usage:%d\r\ncompacting:%d\r\nquarantined:%d\r\n\r\n",
+		stats.Segments, stats.CurrentSize, stats.DiskUsage, boolToInt(stats.Compacting), stats.Quarantined)
+	fmt.Fprintf(&b, "# Stats\r\nkeyspace_hits:%d\r\nkeyspace_misses:%d\r\ncache_size:%d\r\nslowed_writes:%d\r\nstalled_writes:%d\r\n",
+		stats.CacheHits, stats.CacheMisses, stats.CacheSize, stats.SlowedWrites, stats.StalledWrites)
+	return b.String()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
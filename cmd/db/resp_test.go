@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadRespCommand(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		args  []string
+		err   bool
+	}{
+		{input: "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$6\r\na\r\nb c\r\n", args: []string{"SET", "key", "a\r\nb c"}},
+		{input: "*1\r\n$0\r\n\r\n", args: []string{""}},
+		{input: "GET  key\r\n", args: []string{"GET", "key"}},
+		{input: "PING\n", args: []string{"PING"}},
+		{input: "*1\r\n+GET\r\n", err: true},
+		{input: "*x\r\n", err: true},
+		{input: "*-1\r\n", err: true},
+		{input: "*1\r\n$-1\r\n", err: true},
+		{input: "*1\r\n$3\r\nGETX\r\n", err: true},
+		{input: "*2\r\n$3\r\nGET\r\n", err: true},
+		{input: "GET", err: true},
+	} {
+		args, err := readRespCommand(bufio.NewReader(strings.NewReader(tc.input)))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.input, args)
+			}
+		} else if err != nil || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%q: unexpected %q, %v", tc.input, args, err)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"*:1", "user:1", true},
+		{"u?er", "user", true},
+		{"u?er", "uer", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"[abc", "a", false},
+	} {
+		if got := matchGlob(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("matchGlob(%q, %q) = %v", tc.pattern, tc.s, got)
+		}
+	}
+}
+
+func TestRespCommands(t *testing.T) {
+	db := newTestDb(t)
+	run := func(args ...string) string {
+		var out strings.Builder
+		w := &respWriter{bufio.NewWriter(&out)}
+		runRespCommand(db, w, args)
+		w.Flush()
+		return out.String()
+	}
+
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"SET", "key", "value", "EX", "100"}, "+OK\r\n"},
+		{[]string{"GET", "key"}, "$5\r\nvalue\r\n"},
+		{[]string{"SET", "key", "value", "EX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "key", "value", "EX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"NOPE"}, "-ERR unknown command 'NOPE'\r\n"},
+		{[]string{"INCR", "key"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCR", "counter"}, ":1\r\n"},
+		{[]string{"EXISTS", "key", "counter", "missing"}, ":2\r\n"},
+		{[]string{"DEL", "key", "missing"}, ":1\r\n"},
+		{[]string{"GET", "key"}, "$-1\r\n"},
+		{[]string{"SCAN", "x"}, "-ERR invalid cursor\r\n"},
+	} {
+		if reply := run(tc.args...); reply != tc.reply {
+			t.Errorf("%q: unexpected reply %q", tc.args, reply)
+		}
+	}
+
+	// A new value drops the deadline of the old one.
+	run("SET", "ttl", "value", "PX", "1")
+	run("SET", "ttl", "value")
+	if deadline, err := expiry(db, "ttl"); err != nil || !deadline.IsZero() {
+		t.Errorf("Unexpected deadline %v after SET: %v", deadline, err)
+	}
+}
+
+func TestRespScan(t *testing.T) {
+	db := newTestDb(t)
+	var want []string
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	// The keys of the server are not returned.
+	if err := setExpiry(db, "a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	cursor, pages := "0", 0
+	for {
+		var out strings.Builder
+		w := &respWriter{bufio.NewWriter(&out)}
+		runRespCommand(db, w, []string{"SCAN", cursor, "COUNT", "3"})
+		w.Flush()
+
+		r := bufio.NewReader(strings.NewReader(out.String()))
+		if line, _ := readRespLine(r); line != "*2" {
+			t.Fatalf("Unexpected reply %q", out.String())
+		}
+		if _, err := readRespLine(r); err != nil {
+			t.Fatal(err)
+		}
+		cursor, _ = readRespLine(r)
+		page, err := readRespCommand(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, page...)
+		if pages++; cursor == "0" || pages > len(want) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(keys, want) || pages != 3 {
+		t.Errorf("Unexpected keys %q in %d pages", keys, pages)
+	}
+
+	if start, ok := parseScanCursor(formatScanCursor("\x01key")); !ok || start != "\x01key" {
+		t.Errorf("Unexpected cursor key %q", start)
+	}
+	if _, ok := parseScanCursor(formatScanCursor("\x00expire\x00a")); ok {
+		t.Error("A cursor at a key of the server is taken")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+type streamEntry struct {
+	ID    uint64 `json:"id"`
+	Value string `json:"value"`
+}
+
+// streamsHandler serves the streams of the bucket given by the bucket
+// parameter, for the services using the db as a queue:
+//
+//	POST /streams/{stream} appends the value of the JSON body and responds with its ID,
+//	GET /streams/{stream}?from={id}&count={n} returns the entries from the ID,
+//	POST /streams/{stream}/groups/{group}?consumer={name}&count={n} hands out entries to the consumer of the group,
+//	POST /streams/{stream}/groups/{group}/ack?id={id} acknowledges the entry of the ID handed out to the group.
+//
+// A count of 0, the default, returns all the entries of a stream. The count
+// of the entries handed out is required, up to datastore.STREAM_READ_LIMIT,
+// as handing them out writes to the group.
+func streamsHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+
+		bucket, err := db.Bucket(r.URL.Query().Get("bucket"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/streams/"), "/")
+		if *leader != "" && r.Method != "GET" {
+			redirectToLeader(rw, r, *leader)
+			return
+		}
+
+		stream := parts[0]
+		switch {
+		case len(parts) == 1 && r.Method == "POST":
+			addToStream(bucket, stream, rw, r)
+		case len(parts) == 1 && r.Method == "GET":
+			from, err := uintParam(r, "from")
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, err)
+				return
+			}
+			readStream(rw, r, func(count int) ([]datastore.StreamEntry, error) {
+				return bucket.XRange(stream, from, count)
+			})
+		case len(parts) == 3 && parts[1] == "groups" && r.Method == "POST":
+			// The count is checked ahead, readStream parses it again.
+			count, err := uintParam(r, "count")
+			if err == nil && (count == 0 || count > datastore.STREAM_READ_LIMIT) {
+				err = fmt.Errorf("count must be between 1 and %d", datastore.STREAM_READ_LIMIT)
+			}
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, err)
+				return
+			}
+			readStream(rw, r, func(count int) ([]datastore.StreamEntry, error) {
+				return bucket.XReadGroup(stream, parts[2], r.URL.Query().Get("consumer"), count)
+			})
+		case len(parts) == 4 && parts[1] == "groups" && parts[3] == "ack" && r.Method == "POST":
+			id, err := uintParam(r, "id")
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, err)
+				return
+			}
+			if err := bucket.XAck(stream, parts[2], id); errors.Is(err, datastore.ErrStreamName) {
+				writeError(rw, http.StatusBadRequest, err)
+			} else if err != nil {
+				writePutError(rw, err)
+			} else {
+				rw.WriteHeader(http.StatusNoContent)
+			}
+		case len(parts) <= 4:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func addToStream(bucket *datastore.Db, stream string, rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	var entry streamEntry
+	if err != nil || json.Unmarshal(body, &entry) != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := bucket.XAdd(stream, entry.Value)
+	if errors.Is(err, datastore.ErrStreamName) {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writePutError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(rw).Encode(map[string]uint64{"id": id})
+}
+
+// readStream responds with the entries returned by read for the count
+// parameter.
+func readStream(rw http.ResponseWriter, r *http.Request, read func(count int) ([]datastore.StreamEntry, error)) {
+	count, err := uintParam(r, "count")
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	entries, err := read(int(count))
+	if errors.Is(err, datastore.ErrStreamName) {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		// The entries handed out to a group are written down, which
+		// fails like a put.
+		writePutError(rw, err)
+		return
+	}
+
+	list := make([]streamEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = streamEntry{entry.ID, entry.Value}
+	}
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(list)
+}
+
+// uintParam parses the query parameter, 0 if it is missing.
+func uintParam(r *http.Request, name string) (uint64, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(param, 10, 64)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamsGroupHandler(t *testing.T) {
+	db := newTestDb(t)
+	for _, value := range []string{"a", "b", "c"} {
+		if _, err := db.XAdd("jobs", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := streamsHandler(db)
+	serve := func(method, target string) (int, []streamEntry) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest(method, target, nil))
+		var entries []streamEntry
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("%s %s: bad body %q", method, target, rw.Body)
+			}
+		}
+		return rw.Code, entries
+	}
+
+	// Handing out entries changes the group, so it is not served for GET.
+	if status, _ := serve("GET", "/streams/jobs/groups/workers?consumer=c1&count=1"); status != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status %d for GET", status)
+	}
+	for _, target := range []string{
+		"/streams/jobs/groups/workers?consumer=c1",
+		"/streams/jobs/groups/workers?consumer=c1&count=0",
+		"/streams/jobs/groups/workers?consumer=c1&count=1000000",
+		"/streams/jobs/groups/workers?consumer=c1&count=x",
+	} {
+		if status, _ := serve("POST", target); status != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status %d", target, status)
+		}
+	}
+
+	status, entries := serve("POST", "/streams/jobs/groups/workers?consumer=c1&count=2")
+	if status != http.StatusOK || len(entries) != 2 || entries[0] != (streamEntry{1, "a"}) {
+		t.Errorf("Unexpected entries %d %v", status, entries)
+	}
+	status, entries = serve("POST", "/streams/jobs/groups/workers?consumer=c2&count=2")
+	if status != http.StatusOK || len(entries) != 1 || entries[0] != (streamEntry{3, "c"}) {
+		t.Errorf("Unexpected entries of another consumer %d %v", status, entries)
+	}
+}
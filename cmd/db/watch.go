@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/FictProger/architecture2-lab-3/datastore"
+)
+
+type watchEvent struct {
+	Key      string `json:"key"`
+	Value    string `json:"value,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Streamed bool   `json:"streamed,omitempty"`
+	Range    bool   `json:"range,omitempty"`
+	RangeEnd string `json:"rangeEnd,omitempty"`
+	Version  uint64 `json:"version"`
+}
+
+// watchHandler streams the changes of the keys with the given prefix in the
+// given bucket as Server-Sent Events. The stream ends when the subscriber is
+// dropped for being too slow; the client is expected to reconnect and re-read
+// its keys.
+func watchHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		bucket, err := db.Bucket(r.URL.Query().Get("bucket"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		events, cancel := bucket.Watch(r.URL.Query().Get("prefix"))
+		defer cancel()
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(watchEvent{event.Key, event.Value, event.Deleted, event.Streamed, event.Range, event.RangeEnd, event.Version})
+				if err != nil {
+					return
+				}
+
+				name := "put"
+				if event.Deleted {
+					name = "delete"
+				}
+				if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.Version, name, data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 	"io"
@@ -57,7 +58,7 @@ func main() {
 				return
 			}
 
-			resp, err := http.Get(fmt.Sprintf("%s/db/%s", dbAddr, key))
+			resp, err := http.Get(fmt.Sprintf("%s/db/%s", dbAddr, url.PathEscape(key)))
 			if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
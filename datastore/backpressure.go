@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// WRITE_SLOWDOWN is how long a write waits while the segments are over
+// SlowdownSegments.
+const WRITE_SLOWDOWN = time.Millisecond
+
+// ErrWriteStall is returned for a write while the segments are over
+// StallSegments, until the compaction catches up.
+var ErrWriteStall = fmt.Errorf("writes are stalled until the segments are compacted")
+
+// throttle holds a write back when the compaction falls behind: over
+// SlowdownSegments the write waits WRITE_SLOWDOWN, over StallSegments it
+// fails with ErrWriteStall. Either way the compaction is started. Only the
+// segments the compaction can merge are counted, not those kept for the
+// retention window, which no compaction would bring down. db must not be
+// locked, so that the waiting writes don't hold the others up.
+func (db *Db) throttle() error {
+	slowdown, stall := db.opts.SlowdownSegments, db.opts.StallSegments
+	if slowdown <= 0 && stall <= 0 {
+		return nil
+	}
+
+	db.Lock()
+	segments := len(db.compactionRun())
+	switch {
+	case stall > 0 && segments >= stall:
+		db.stalledWrites++
+	case slowdown > 0 && segments >= slowdown:
+		db.slowedWrites++
+	default:
+		db.Unlock()
+		return nil
+	}
+	db.Unlock()
+
+	db.wakeCompaction()
+	if stall > 0 && segments >= stall {
+		return ErrWriteStall
+	}
+	time.Sleep(WRITE_SLOWDOWN)
+	return nil
+}
+
+// wakeCompaction makes MergeRoutine compact the segments without waiting for
+// its next round.
+func (db *Db) wakeCompaction() {
+	select {
+	case db.compactWake <- struct{}{}:
+	default:
+	}
+}
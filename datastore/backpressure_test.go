@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Backpressure(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	fs.MkdirAll("/retained")
+	open := func(dir string, opts Options) *Db {
+		opts.FS = fs
+		opts.SlowdownSegments = 2
+		opts.StallSegments = 4
+		db, err := NewDbWithOptions(dir, "current-data", false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	value := strings.Repeat("v", 1000)
+
+	// The segments within the retention window are not counted, as no
+	// compaction would merge them.
+	db := open("/retained", Options{Retention: time.Hour, ManualCompaction: true})
+	for i := 0; db.Stats().Segments < 6; i++ {
+		if err := db.Put(fmt.Sprintf("key_%d", i), value); err != nil {
+			t.Fatalf("Expected no stall for the retained segments, got %v", err)
+		}
+	}
+	db.Close()
+
+	// Without the background compaction the segments pile up.
+	db = open("/db", Options{ManualCompaction: true})
+	var err error
+	for i := 0; err == nil; i++ {
+		err = db.Put(fmt.Sprintf("key_%d", i), value)
+	}
+	if err != ErrWriteStall {
+		t.Fatalf("Expected ErrWriteStall, got %v", err)
+	}
+
+	stats := db.Stats()
+	if stats.Segments != 4 {
+		t.Errorf("Expected the writes to stall at 4 segments, got %d", stats.Segments)
+	}
+	if stats.SlowedWrites == 0 || stats.StalledWrites != 1 {
+		t.Errorf("Expected slowed and stalled writes, got %d and %d", stats.SlowedWrites, stats.StalledWrites)
+	}
+	if err := db.Delete("key_0"); err != ErrWriteStall {
+		t.Errorf("Expected ErrWriteStall for a deletion, got %v", err)
+	}
+	db.Close()
+
+	db = open("/db", Options{})
+	defer db.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := db.Put("key", "value")
+		if err == nil {
+			break
+		} else if err != ErrWriteStall || time.Now().After(deadline) {
+			t.Fatalf("Expected the compaction to end the stall, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if segments := db.Stats().Segments; segments >= 2 {
+		t.Errorf("Expected the segments to be compacted, got %d", segments)
+	}
+}
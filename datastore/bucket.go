@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+)
+
+// Buckets are named key spaces stored next to the default one, each in its
+// own directory under dir/buckets with its own segments and merging. The Db
+// itself is the default bucket.
+const bucketsDir = "buckets"
+
+var (
+	ErrBucketNotFound = fmt.Errorf("bucket does not exist")
+	ErrBucketExists   = fmt.Errorf("bucket already exists")
+	ErrBucketName     = fmt.Errorf("bucket name must consist of letters, digits, '-' and '_'")
+)
+
+var bucketNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// CreateBucket creates an empty bucket.
+func (db *Db) CreateBucket(name string) (*Db, error) {
+	if !bucketNameRe.MatchString(name) {
+		return nil, ErrBucketName
+	}
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	root := path.Join(db.dir, bucketsDir)
+	if _, err := db.fs.Stat(root); os.IsNotExist(err) {
+		if err := db.fs.Mkdir(root, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.fs.Mkdir(path.Join(root, name), os.ModePerm); os.IsExist(err) {
+		return nil, ErrBucketExists
+	} else if err != nil {
+		return nil, err
+	}
+	return db.openBucket(name)
+}
+
+// Bucket returns the bucket with the given name, or the Db itself for an
+// empty name.
+func (db *Db) Bucket(name string) (*Db, error) {
+	if name == "" {
+		return db, nil
+	}
+	if !bucketNameRe.MatchString(name) {
+		return nil, ErrBucketNotFound
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if bucket, ok := db.buckets[name]; ok {
+		return bucket, nil
+	}
+	if _, err := db.fs.Stat(path.Join(db.dir, bucketsDir, name)); os.IsNotExist(err) {
+		return nil, ErrBucketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return db.openBucket(name)
+}
+
+func (db *Db) openBucket(name string) (*Db, error) {
+	// The progress is reported for the recovery of the Db only.
+	opts := db.opts
+	opts.OnRecoveryProgress = nil
+	bucket, err := NewDbWithOptions(path.Join(db.dir, bucketsDir, name), "current-data", false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.buckets == nil {
+		db.buckets = make(map[string]*Db)
+	}
+	db.buckets[name] = bucket
+	if db.quota != nil {
+		bucket.Lock()
+		bucket.quota, bucket.bucketName = db.quota, name
+		bucket.reportUsage()
+		bucket.Unlock()
+	}
+	return bucket, nil
+}
+
+// ListBuckets returns the names of the buckets, not including the default one.
+func (db *Db) ListBuckets() ([]string, error) {
+	files, err := db.fs.ReadDir(path.Join(db.dir, bucketsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// DropBucket closes the bucket and removes all its data.
+func (db *Db) DropBucket(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		return err
+	}
+	if bucket == db {
+		return fmt.Errorf("the default bucket can't be dropped")
+	}
+
+	db.Lock()
+	delete(db.buckets, name)
+	db.Unlock()
+
+	if err := bucket.Close(); err != nil {
+		return err
+	}
+	if err := removeAll(db.fs, bucket.dir); err != nil {
+		return err
+	}
+	if db.quota != nil {
+		db.quota.Lock()
+		delete(db.quota.sizes, name)
+		db.quota.Unlock()
+	}
+	return nil
+}
+
+func removeAll(fs FS, dir string) error {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := path.Join(dir, f.Name())
+		if f.IsDir() {
+			err = removeAll(fs, name)
+		} else {
+			err = fs.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fs.Remove(dir)
+}
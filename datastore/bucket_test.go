@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Buckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("isolated keys", func(t *testing.T) {
+		bucket, err := db.CreateBucket("team-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.CreateBucket("team-a"); err != ErrBucketExists {
+			t.Errorf("Expected ErrBucketExists, got %v", err)
+		}
+
+		db.Put("key", "default")
+		bucket.Put("key", "team-a")
+
+		if value, _ := db.Get("key"); value != "default" {
+			t.Errorf("Bad value in the default bucket: %s", value)
+		}
+		if value, _ := bucket.Get("key"); value != "team-a" {
+			t.Errorf("Bad value in team-a: %s", value)
+		}
+	})
+
+	t.Run("list and reopen", func(t *testing.T) {
+		if _, err := db.CreateBucket("team-b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.CreateBucket("../escape"); err != ErrBucketName {
+			t.Errorf("Expected ErrBucketName, got %v", err)
+		}
+
+		db.Close()
+		db, err = NewDb(dir, "current-data", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := db.ListBuckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, []string{"team-a", "team-b"}) {
+			t.Errorf("Unexpected buckets %v", names)
+		}
+
+		bucket, err := db.Bucket("team-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := bucket.Get("key"); value != "team-a" {
+			t.Errorf("Bad value in team-a after reopening: %s", value)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		bucket, err := db.Bucket("team-b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 60000; i++ {
+			bucket.Put(fmt.Sprintf("very_long_key_%d", i%20000), fmt.Sprintf("value_%d", i))
+		}
+		bucket.Delete("very_long_key_5")
+
+		if err := bucket.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if segments := bucket.Stats().Segments; segments != 1 {
+			t.Errorf("Expected one segment after compaction, got %d", segments)
+		}
+		if value, _ := bucket.Get("very_long_key_10"); value != "value_40010" {
+			t.Errorf("Bad value after compaction: %s", value)
+		}
+		if _, err := bucket.Get("very_long_key_5"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropBucket("team-a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Bucket("team-a"); err != ErrBucketNotFound {
+			t.Errorf("Expected ErrBucketNotFound, got %v", err)
+		}
+		if value, _ := db.Get("key"); value != "default" {
+			t.Errorf("Bad value in the default bucket: %s", value)
+		}
+	})
+}
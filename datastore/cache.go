@@ -0,0 +1,85 @@
+package datastore
+
+import "container/list"
+
+// valueCache is an LRU cache of values bounded by the total size of the
+// cached keys and values. It is guarded by the lock of the Db owning it.
+type valueCache struct {
+	budget int64
+	size   int64
+	order  *list.List
+	items  map[string]*list.Element
+
+	hits, misses uint64
+}
+
+type cacheItem struct {
+	key   string
+	value []byte
+}
+
+func newValueCache(budget int64) *valueCache {
+	return &valueCache{
+		budget: budget,
+		order:  list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheItem).value, true
+}
+
+// add caches the value, evicting the least recently used ones to stay within
+// the budget. Values larger than the whole budget are not cached.
+func (c *valueCache) add(key string, value []byte) {
+	if c == nil {
+		return
+	}
+
+	itemSize := int64(len(key) + len(value))
+	if itemSize > c.budget {
+		return
+	}
+
+	c.remove(key)
+	c.items[key] = c.order.PushFront(&cacheItem{key, value})
+	c.size += itemSize
+
+	for c.size > c.budget {
+		c.remove(c.order.Back().Value.(*cacheItem).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		item := c.order.Remove(el).(*cacheItem)
+		delete(c.items, key)
+		c.size -= int64(len(item.key) + len(item.value))
+	}
+}
+
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(10)
+
+	c.add("a", []byte("1111"))
+	c.add("b", []byte("2222"))
+	if _, ok := c.get("a"); !ok {
+		t.Errorf("Expected a to be cached")
+	}
+
+	// a was used recently, so b is evicted.
+	c.add("c", []byte("3333"))
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Errorf("Expected a to stay cached")
+	}
+	if c.size != 10 {
+		t.Errorf("Unexpected cache size %d", c.size)
+	}
+
+	c.add("big", []byte("0123456789"))
+	if _, ok := c.get("big"); ok {
+		t.Errorf("A value over the budget must not be cached")
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, "current-data", false, Options{CacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := db.Get("key"); err != nil || value != "value1" {
+			t.Errorf("Bad value returned expected value1, got %s (%v)", value, err)
+		}
+	}
+	if stats := db.Stats(); stats.CacheHits != 2 || stats.CacheMisses != 1 {
+		t.Errorf("Unexpected cache counters %+v", stats)
+	}
+
+	t.Run("invalidated by put", func(t *testing.T) {
+		if err := db.Put("key", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key"); err != nil || value != "value2" {
+			t.Errorf("Bad value returned expected value2, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("invalidated by delete", func(t *testing.T) {
+		if err := db.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// checkpointManifest lists the segments of a checkpoint with their sizes. It
+// is written last, so a checkpoint directory without it is incomplete.
+const checkpointManifest = "checkpoint"
+
+// Checkpoint writes a copy of the Db and its buckets to dir, which must not
+// exist yet. The current file is sealed into a segment first, and then only
+// the segments are copied: they don't change while merging is paused, so
+// reads and writes go on during the copy. The copy is opened as a normal Db.
+// A read-only Db can't be checkpointed, as sealing the current file writes.
+func (db *Db) Checkpoint(dir string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if err := db.fs.Mkdir(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := db.checkpoint(dir); err != nil {
+		removeAll(db.fs, dir)
+		return err
+	}
+	return nil
+}
+
+func (db *Db) checkpoint(dir string) error {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.Lock()
+	if db.outOffset > 0 {
+		if err := db.roll(); err != nil {
+			db.Unlock()
+			return err
+		}
+	}
+	segments, err := db.fs.ReadDir(db.segPath)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+
+	segPath := path.Join(dir, "segments")
+	if err := db.fs.Mkdir(segPath, os.ModePerm); err != nil {
+		return err
+	}
+	var manifest []byte
+	for _, segment := range segments {
+		name := segment.Name()
+		if err := copyPrefix(db.fs, path.Join(db.segPath, name), path.Join(segPath, name), segment.Size()); err != nil {
+			return err
+		}
+		manifest = append(manifest, fmt.Sprintf("%s %d\n", name, segment.Size())...)
+	}
+
+	names, err := db.ListBuckets()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		if err := db.fs.Mkdir(path.Join(dir, bucketsDir), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		bucket, err := db.Bucket(name)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Checkpoint(path.Join(dir, bucketsDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return writeSynced(db.fs, path.Join(dir, checkpointManifest), manifest)
+}
+
+func writeSynced(fs FS, name string, data []byte) error {
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, OS_OPEN_PERM)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDb_Checkpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbDir, backupDir := path.Join(dir, "db"), path.Join(dir, "backup")
+	os.Mkdir(dbDir, os.ModePerm)
+
+	db, err := NewDb(dbDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Delete("key2")
+	bucket, err := db.CreateBucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket.Put("key", "team")
+
+	if err := db.Checkpoint(backupDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(backupDir); !os.IsExist(err) {
+		t.Errorf("Expected an error for an existing directory, got %v", err)
+	}
+
+	db.Put("key3", "value3")
+	checkValues(t, db, map[string]string{"key1": "value1", "key3": "value3"})
+
+	backup, err := NewDb(backupDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	checkValues(t, backup, map[string]string{"key1": "value1"})
+	for _, key := range []string{"key2", "key3"} {
+		if _, err := backup.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+		}
+	}
+
+	backupBucket, err := backup.Bucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, backupBucket, map[string]string{"key": "team"})
+}
@@ -0,0 +1,331 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// compactionFile is the file in the Db directory the compacted segment is
+// written to before it takes the place of the merged ones.
+const compactionFile = "compaction-data"
+
+// compactionProgress is the state of the running compaction.
+type compactionProgress struct {
+	sync.Mutex
+	running     bool
+	done, total int64
+}
+
+func (p *compactionProgress) start(total int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.running, p.done, p.total = true, 0, total
+}
+
+func (p *compactionProgress) add(n int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.done += n
+}
+
+func (p *compactionProgress) stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.running = false
+}
+
+// rateLimiter paces the I/O to rate bytes a second. It doesn't limit anything
+// when rate is zero.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.bytes += int64(n)
+	due := time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second))
+	if ahead := due - time.Since(l.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// blobLocation is the file and the offset of a blob record.
+type blobLocation struct {
+	filePath string
+	offset   int64
+}
+
+// recordKey returns the key of the encoded record.
+func recordKey(record []byte) string {
+	keySize := binary.LittleEndian.Uint32(record[4:])
+	return string(record[8 : 8+keySize])
+}
+
+// inForce reports whether the record of the key written at ts at the offset
+// of run[j] is in force among the files of the run, which go from the oldest
+// one: it is the last record of the key in its file, a later range tombstone
+// of the file doesn't delete it, and the newer files have neither a record of
+// the key nor a range tombstone covering it.
+func inForce(run []*Db, j int, key string, offset, ts int64) bool {
+	file := run[j]
+	if position, ok := file.index[key]; !ok || position != offset {
+		return false
+	}
+	if r, ok := file.newestRange(key); ok && r.deletes(ts, offset) {
+		return false
+	}
+	for _, newer := range run[j+1:] {
+		if _, ok := newer.index[key]; ok {
+			return false
+		}
+		if _, ok := newer.newestRange(key); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// holds reports whether the current file or a segment has a record of the key
+// or a range tombstone covering it. db must be locked.
+func (db *Db) holds(key string) bool {
+	for _, file := range append([]*Db{db}, db.segmentsDb...) {
+		if _, ok := file.index[key]; ok {
+			return true
+		}
+		if _, ok := file.newestRange(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compactionRun returns the segments to compact: the oldest ones up to the
+// newest segment written before the retention window. Compacting a newer
+// segment would drop the versions replaced within the window. db must be
+// locked.
+func (db *Db) compactionRun() []*Db {
+	segments := db.segmentsDb
+	cutoff := time.Now().Add(-db.opts.Retention).UnixNano()
+	for i := len(segments) - 1; i > 0; i-- {
+		if db.opts.Retention > 0 && segments[i].maxTimestamp >= cutoff {
+			continue
+		}
+		// The run is copied, as rolls append to the segments meanwhile.
+		return append([]*Db(nil), segments[:i+1]...)
+	}
+	return nil
+}
+
+// compactSegments merges the segments picked by compactionRun into one. The
+// segments are read sequentially and the records in force are written to
+// a new file, which then takes the place of the merged segments. The
+// I/O is paced to CompactionRate. db is locked only to pick the segments and
+// to swap them, so reads and writes go on during the compaction. It reports
+// false if there was nothing to merge.
+func (db *Db) compactSegments() (bool, error) {
+	if err := db.checkWritable(); err != nil {
+		return false, err
+	}
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.Lock()
+	run := db.compactionRun()
+	otherRefs := db.otherRefs(run...)
+	db.Unlock()
+	if len(run) < 2 {
+		return false, nil
+	}
+
+	var total int64
+	for _, segment := range run {
+		total += segment.outOffset
+	}
+	db.compaction.start(total)
+	defer db.compaction.stop()
+
+	tmpPath := path.Join(db.dir, compactionFile)
+	blobs, err := db.writeCompacted(run, tmpPath, otherRefs)
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return false, err
+	}
+	compacted, err := db.openSegment(db.dir, compactionFile)
+	if err != nil {
+		db.fs.Remove(tmpPath)
+		return false, err
+	}
+
+	db.Lock()
+	err = db.swapCompacted(run, compacted, blobs)
+	db.Unlock()
+	if err != nil {
+		compacted.Close()
+		db.fs.Remove(tmpPath)
+		return false, err
+	}
+
+	// Nothing reads the merged segments after the swap, and the recovery
+	// removes them if a crash comes first.
+	for _, segment := range run {
+		segment.Close()
+		if err := db.fs.Remove(segment.outPath); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// writeCompacted writes the records of the run in force to the file. The blob
+// records are written last, those referred to from the file or counted in
+// otherRefs; the locations of all the blobs of the run are returned.
+func (db *Db) writeCompacted(run []*Db, filePath string, otherRefs map[[sha1.Size]byte]int) (map[[sha1.Size]byte]blobLocation, error) {
+	out, err := db.fs.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, OS_OPEN_PERM)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, RECOVER_BUF_SIZE)
+	limiter := rateLimiter{rate: db.opts.CompactionRate, start: time.Now()}
+	blobs := make(map[[sha1.Size]byte]blobLocation)
+	refs := make(map[[sha1.Size]byte]int)
+
+	for j, file := range run {
+		var (
+			offset   int64
+			writeErr error
+		)
+		err := scanRecords(db.fs, file.outPath, file.outOffset, func(record []byte) {
+			position := offset
+			offset += int64(len(record))
+			limiter.wait(len(record))
+			db.compaction.add(int64(len(record)))
+			if writeErr != nil {
+				return
+			}
+			select {
+			case <-db.closed:
+				writeErr = os.ErrClosed
+				return
+			default:
+			}
+
+			key := recordKey(record)
+			switch {
+			case isBatch(record):
+				return
+			case isTombstone(record), isRangeTombstone(record):
+				// The run starts at the oldest segment, so the versions
+				// deleted by the tombstones are all merged here, and the
+				// merged segments left by a crash are superseded.
+				return
+			case isBlob(record):
+				var hash [sha1.Size]byte
+				copy(hash[:], key)
+				if _, ok := blobs[hash]; !ok {
+					blobs[hash] = blobLocation{file.outPath, position}
+				}
+				return
+			case !inForce(run, j, key, position, recordTimestamp(record)):
+				return
+			}
+
+			if hash, ok := referenceHash(record); ok {
+				refs[hash]++
+			}
+			_, writeErr = w.Write(record)
+			limiter.wait(len(record))
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for hash, location := range blobs {
+		if refs[hash]+otherRefs[hash] == 0 {
+			continue
+		}
+		record, err := readRecordAt(db.fs, location.filePath, location.offset)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(record); err != nil {
+			return nil, err
+		}
+		limiter.wait(2 * len(record))
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return blobs, out.Sync()
+}
+
+// swapCompacted puts the compacted segment in place of the merged run. db must
+// be locked.
+func (db *Db) swapCompacted(run []*Db, compacted *Db, blobs map[[sha1.Size]byte]blobLocation) error {
+	// A value put during the compaction may refer to a blob that was dropped,
+	// such a blob is copied now.
+	refs := db.otherRefs(run...)
+	for hash, n := range compacted.refCounts {
+		refs[hash] += n
+	}
+	copied := false
+	for hash, location := range blobs {
+		if _, ok := compacted.blobs[hash]; ok || refs[hash] == 0 {
+			continue
+		}
+		record, err := readRecordAt(db.fs, location.filePath, location.offset)
+		if err != nil {
+			return err
+		}
+		if err := compacted.append(string(hash[:]), record); err != nil {
+			return err
+		}
+		copied = true
+	}
+	if copied {
+		if err := compacted.out.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// The compacted segment gets the number of the newest merged one and
+	// a newer generation, so that the positions of the followers in the
+	// merged segment are told apart.
+	number, generation := parseSegmentName(path.Base(run[len(run)-1].outPath))
+	for _, segment := range db.segmentsDb {
+		if n, g := parseSegmentName(path.Base(segment.outPath)); n == number && g > generation {
+			generation = g
+		}
+	}
+	segPath := path.Join(db.segPath, segmentName(number, generation+1))
+	if err := db.fs.Rename(compacted.outPath, segPath); err != nil {
+		return err
+	}
+	compacted.outPath = segPath
+
+	// The run is at the start of the segments, the segments rolled since
+	// were added after it.
+	db.segmentsDb = append([]*Db{compacted}, db.segmentsDb[len(run):]...)
+
+	db.segmentsSize = 0
+	for _, segment := range db.segmentsDb {
+		db.segmentsSize += segment.outOffset
+	}
+	db.reportUsage()
+	return nil
+}
@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Compaction(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	open := func(opts Options) *Db {
+		opts.FS = fs
+		db, err := NewDbWithOptions("/db", "current-data", false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	// Nothing is compacted within the retention window while the data is
+	// written.
+	db := open(Options{Retention: time.Hour})
+	// The deleted values go to the segments along with their tombstones.
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 10000; i++ {
+		db.Put(fmt.Sprintf("deleted_%d", i), value)
+	}
+	for i := 0; i < 10000; i++ {
+		db.Delete(fmt.Sprintf("deleted_%d", i))
+	}
+	pairs := fillSegments(t, db)
+	db.Close()
+
+	// The segments are compacted in the background once the Db is opened,
+	// Compact waits for that.
+	const rate = 8 * 1024 * 1024
+	start := time.Now()
+	db = open(Options{CompactionRate: rate})
+	defer func() { db.Close() }()
+	total := db.Stats().DiskUsage - db.Stats().CurrentSize
+
+	t.Run("writes go on", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- db.Compact() }()
+
+		for !db.Stats().Compacting {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("new_key_%d", i)
+			putStart := time.Now()
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(putStart); elapsed > 50*time.Millisecond {
+				t.Errorf("Put waited %s for the compaction", elapsed)
+			}
+			pairs[key] = "value"
+		}
+		time.Sleep(100 * time.Millisecond)
+		if stats := db.Stats(); stats.CompactedBytes <= 0 || stats.CompactionBytes != total {
+			t.Errorf("Bad progress %d of %d bytes, expected a total of %d", stats.CompactedBytes, stats.CompactionBytes, total)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if elapsed, min := time.Since(start), time.Duration(total*int64(time.Second)/rate); elapsed < min {
+			t.Errorf("Compaction took %s, the rate allows %s at least", elapsed, min)
+		}
+		if stats := db.Stats(); stats.Compacting || stats.CompactedBytes != total || stats.Segments != 1 {
+			t.Errorf("Unexpected stats after the compaction %+v", stats)
+		}
+	})
+
+	t.Run("records in force", func(t *testing.T) {
+		checkValues(t, db, pairs)
+		for _, key := range []string{"deleted_0", "deleted_9999"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for deleted %s, got %v", key, err)
+			}
+		}
+		if stats := db.Stats(); stats.DiskUsage-stats.CurrentSize >= total {
+			t.Errorf("Expected the compaction to free space, the segments take %d bytes of %d", stats.DiskUsage-stats.CurrentSize, total)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		// The output of an interrupted compaction is dropped.
+		writeFile(t, fs, "/db/"+compactionFile, []byte("partial"))
+		db = open(Options{})
+		if _, err := fs.Stat("/db/" + compactionFile); err == nil {
+			t.Errorf("Expected the compaction leftover to be removed")
+		}
+		checkValues(t, db, pairs)
+	})
+
+	t.Run("rolls start compaction", func(t *testing.T) {
+		for key, value := range fillSegments(t, db) {
+			pairs[key] = value
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for db.Stats().Segments > 1 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if segments := db.Stats().Segments; segments != 1 {
+			t.Errorf("Expected the rolled segments to be compacted, got %d segments", segments)
+		}
+		checkValues(t, db, pairs)
+	})
+}
+
+func TestDb_CompactionDropsTombstones(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	fs.MkdirAll("/saved")
+	open := func() *Db {
+		db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs, ManualCompaction: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	check := func(db *Db, pairs map[string]string) {
+		t.Helper()
+		for _, key := range []string{"tenant_1", "kept_0"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+			}
+		}
+		checkValues(t, db, pairs)
+	}
+
+	db := open()
+	for i := 0; i < 100; i++ {
+		db.Put(fmt.Sprintf("tenant_%d", i), "value")
+		db.Put(fmt.Sprintf("kept_%d", i), "value")
+	}
+	if err := db.DeleteRange("tenant_", "tenant`"); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete("kept_0")
+	pairs := fillSegments(t, db)
+	pairs["kept_1"] = "value"
+
+	// The segments are saved to put them back after the compaction, as if
+	// it crashed before removing them.
+	files, err := fs.ReadDir("/db/segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := copyPrefix(fs, "/db/segments/"+f.Name(), "/saved/"+f.Name(), f.Size()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	for _, segment := range db.segmentsDb {
+		if len(segment.ranges) > 0 || len(segment.tombstones) > 0 {
+			t.Errorf("Expected the tombstones to be dropped, %s has %d range and %d point tombstones",
+				segment.outPath, len(segment.ranges), len(segment.tombstones))
+		}
+	}
+	db.Unlock()
+	check(db, pairs)
+	db.Close()
+
+	for _, f := range files {
+		if err := fs.Rename("/saved/"+f.Name(), "/db/segments/"+f.Name()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = open()
+	defer db.Close()
+	check(db, pairs)
+	if left, _ := fs.ReadDir("/db/segments"); len(left) != 1 {
+		t.Errorf("Expected the merged segments to be removed, got %d segments", len(left))
+	}
+}
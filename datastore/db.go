@@ -2,14 +2,17 @@ package datastore
 
 import (
 	"bufio"
+	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,12 +29,87 @@ const (
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+// ErrCorrupted is returned for a file with a damaged record.
+var ErrCorrupted = fmt.Errorf("corrupted file")
+
 type hashIndex map[string]int64
 
+// Options tune a Db opened with NewDbWithOptions. The zero value keeps the
+// behaviour of NewDb.
+type Options struct {
+	// CacheSize is the memory budget in bytes of the cache of read values.
+	// The cache is disabled when it is zero.
+	CacheSize int64
+
+	// FS is the file system holding the data, the disk when it is nil.
+	FS FS
+
+	// SyncWrites makes every write wait until the record is flushed to the
+	// disk, so that it survives a crash of the machine.
+	SyncWrites bool
+
+	// Retention is how long the old versions of the keys are kept for
+	// History and GetAt. Merging drops only the versions replaced earlier.
+	Retention time.Duration
+
+	// MaxKeySize and MaxValueSize limit the sizes of the keys and the values
+	// put, in bytes. There is no limit when they are zero.
+	MaxKeySize   int
+	MaxValueSize int64
+
+	// DiskQuota limits the total size of the current files and the segments
+	// of the Db and all its buckets. Deletions are allowed over the quota, as
+	// merging them frees the space. There is no limit when it is zero.
+	DiskQuota int64
+
+	// Dedup stores a value of at least DEDUP_MIN_SIZE bytes once for all the
+	// keys holding it, found by its hash. Merging drops a stored value once
+	// no key refers to it. Streamed values and the values written by
+	// transactions are always stored in full.
+	Dedup bool
+
+	// MmapSegments makes the segments read from their memory mappings rather
+	// than through a buffered reader. It has effect on Linux only.
+	MmapSegments bool
+
+	// SlowdownSegments and StallSegments hold the writes back while the
+	// compaction falls behind: with that many segments every write waits
+	// WRITE_SLOWDOWN, or fails with ErrWriteStall, respectively. The
+	// segments within the Retention window are not counted, as they are not
+	// compacted yet. Replicated writes are not held back. There is no threshold when it is zero.
+	SlowdownSegments int
+	StallSegments    int
+
+	// ManualCompaction turns the background compaction off, the segments
+	// are then merged only by Compact.
+	ManualCompaction bool
+
+	// CompactionRate limits the reads and writes of the compaction to this
+	// many bytes a second. There is no limit when it is zero.
+	CompactionRate int64
+
+	// RecoveryWorkers is the number of segments recovered at once when the
+	// Db is opened, GOMAXPROCS when it is zero.
+	RecoveryWorkers int
+
+	// OnRecoveryProgress, if set, is called when the Db is opened with the
+	// total number of segments and then after every recovered one. The calls
+	// don't overlap.
+	OnRecoveryProgress func(recovered, total int)
+
+	// ReadOnly opens the files without write access. Writes and merging fail
+	// with ErrReadOnly, and the changes made by a writer of the directory are
+	// seen after Refresh.
+	ReadOnly bool
+}
+
 type Db struct {
 	sync.Mutex
 
-	out *os.File
+	fs FS
+	syncWrites bool
+
+	out File
 	outPath string
 	dir string
 	segPath string
@@ -39,31 +117,153 @@ type Db struct {
 	index hashIndex
 	lastSegmentNum int64
 	segmentsDb []*Db
+	segmentsSize int64
+	forMerge bool
+	maxTimestamp int64
+	// tombstones holds the keys deleted by their last record in the file.
+	tombstones map[string]struct{}
+	// ranges holds the range tombstones of the file in the order of writing.
+	ranges []rangeTombstone
+	// blobs holds the offsets of the blob records of the file by the value
+	// hash, refCounts the number of the reference records to every hash.
+	blobs     map[[sha1.Size]byte]int64
+	refCounts map[[sha1.Size]byte]int
+
+	version uint64
+	// keyVersions holds the version of the last change of the keys changed
+	// lately, for the transactions, and forgottenVersion the newest version
+	// dropped from it.
+	keyVersions      map[string]uint64
+	forgottenVersion uint64
+	// rangeVersion is the version of the last range deletion.
+	rangeVersion uint64
+	watchers map[*watcher]struct{}
+
+	cache *valueCache
+	// mapped reads a segment when MmapSegments is set.
+	mapped *mappedFile
+
+	opts Options
+	buckets map[string]*Db
+	// quota adds up the usage of the Db and its buckets for DiskQuota, where
+	// the Db is the bucket of bucketName.
+	quota *diskUsage
+	bucketName string
+
+	// quarantined counts the corrupted files moved to the quarantine.
+	quarantined int
+
+	// mergeMu keeps the segments unchanged while a checkpoint copies them.
+	mergeMu sync.Mutex
+	compaction compactionProgress
+	// compactWake starts MergeRoutine ahead of time, closed stops it.
+	compactWake chan struct{}
+	closed chan struct{}
+	slowedWrites, stalledWrites uint64
+
+	// streamIDs holds the last entry ID of every stream added to, and
+	// streamGroups the state of every consumer group read by its groupKey.
+	streamIDs map[string]uint64
+	streamGroups map[string]*streamGroup
 }
 
 func NewDb(dir, outFileName string, forMerge bool) (*Db, error) {
+	return NewDbWithOptions(dir, outFileName, forMerge, Options{})
+}
+
+func NewDbWithOptions(dir, outFileName string, forMerge bool, opts Options) (*Db, error) {
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+
 	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, OS_OPEN_FLAG, OS_OPEN_PERM)
+	var f File
+	var err error
+	var lastSegmentNum int64
+	if opts.ReadOnly && !forMerge {
+		// The segments are listed before the current file is opened, so
+		// that Refresh sees a roll in between.
+		files, err := fs.ReadDir(path.Join(dir, "/segments"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		lastSegmentNum = nextSegmentNumber(files)
+	}
+	if opts.ReadOnly {
+		f, err = openReadOnly(fs, outputPath, forMerge)
+	} else {
+		f, err = fs.OpenFile(outputPath, OS_OPEN_FLAG, OS_OPEN_PERM)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	db := &Db{
+		opts:    opts,
+		fs:      fs,
+		syncWrites: opts.SyncWrites,
 		outPath: outputPath,
 		out:     f,
 		index:   make(hashIndex),
+		tombstones: make(map[string]struct{}),
+		blobs: make(map[[sha1.Size]byte]int64),
+		refCounts: make(map[[sha1.Size]byte]int),
 		dir:     dir,
 		segPath: path.Join(dir, "/segments"),
+		forMerge: forMerge,
+		compactWake: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		lastSegmentNum: lastSegmentNum,
+	}
+	if opts.ReadOnly {
+		db.out = nil
+		if f != nil {
+			db.mapped = &mappedFile{file: f}
+		}
 	}
 
 	err = db.recover()
+	if err == ErrCorrupted {
+		if forMerge {
+			f.Close()
+			return nil, &corruptedError{valid: db.outOffset}
+		}
+		if opts.ReadOnly {
+			db.mapped.close()
+			return nil, err
+		}
+		err = db.quarantineCurrent()
+	}
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
-	if !forMerge {
-		if _, err := os.Stat(db.segPath); os.IsNotExist(err) {
-			if err := os.Mkdir(db.segPath, os.ModePerm); err != nil {
+	if opts.ReadOnly && opts.MmapSegments && db.mapped != nil {
+		db.mapped.data, _ = mmap(f, db.outOffset)
+	} else if forMerge && opts.MmapSegments {
+		if db.mapped, err = openMapped(fs, outputPath, db.outOffset); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if !forMerge && opts.ReadOnly {
+		if err := db.recoverSegments(opts.OnRecoveryProgress); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if opts.CacheSize > 0 {
+			db.cache = newValueCache(opts.CacheSize)
+		}
+	} else if !forMerge {
+		// A compaction or a PutStream interrupted by a crash leaves its
+		// output behind.
+		fs.Remove(path.Join(dir, compactionFile))
+		removeStreamFiles(fs, dir)
+
+		if _, err := fs.Stat(db.segPath); os.IsNotExist(err) {
+			if err := fs.Mkdir(db.segPath, os.ModePerm); err != nil {
 				return nil, err
 			}
 		}
@@ -72,222 +272,824 @@ func NewDb(dir, outFileName string, forMerge bool) (*Db, error) {
 			return nil, err
 		}
 
-		if err := db.recoverSegments(); err != nil && err != io.EOF {
+		if err := db.recoverSegments(opts.OnRecoveryProgress); err != nil && err != io.EOF {
 			return nil, err
 		}
 
-		go db.MergeRoutine()
+		if opts.CacheSize > 0 {
+			db.cache = newValueCache(opts.CacheSize)
+		}
+
+		if opts.DiskQuota > 0 {
+			if db.quota, err = newDiskUsage(fs, dir); err != nil {
+				db.Close()
+				return nil, err
+			}
+			db.reportUsage()
+		}
+
+		if !opts.ManualCompaction {
+			go db.MergeRoutine()
+		}
 	}
 
 	return db, nil
 }
 
 func (db *Db) Close() error {
+	db.Lock()
+	select {
+	case <-db.closed:
+	default:
+		close(db.closed)
+	}
+	db.Unlock()
+
+	// A compaction under way stops once the Db is closed and is waited for,
+	// so that it doesn't remove the segments after Close returns.
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.Lock()
+	for _, bucket := range db.buckets {
+		bucket.Close()
+	}
+	db.buckets = nil
+	for _, segment := range db.segmentsDb {
+		segment.Close()
+	}
+	if db.mapped != nil {
+		db.mapped.close()
+	}
+	db.Unlock()
+
+	if db.out == nil {
+		// A read-only Db reads the current file through db.mapped.
+		return nil
+	}
 	return db.out.Close()
 }
 
 func (db *Db) Get(key string) (string, error) {
+	value, err := db.GetBytes([]byte(key))
+	return string(value), err
+}
+
+// GetVersion is Get that also returns the version of the key, as described in
+// Tx.GetVersion.
+func (db *Db) GetVersion(key string) (string, uint64, error) {
 	db.Lock()
 	defer db.Unlock()
 
+	value, err := db.getCached(key)
+	return string(value), db.keyVersion(key), err
+}
+
+// GetBytes is Get for binary keys and values.
+func (db *Db) GetBytes(key []byte) ([]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.getCached(string(key))
+}
+
+// getCached is get through the cache, with the deletions reported as
+// ErrNotFound. db must be locked.
+func (db *Db) getCached(key string) ([]byte, error) {
+	if value, ok := db.cache.get(key); ok {
+		return append([]byte(nil), value...), nil
+	}
+
+	value, err := db.get(key)
+	if ref, ok := err.(*blobRef); ok {
+		value, err = db.readBlob(ref.hash)
+	}
+	if err == errDeleted {
+		return nil, ErrNotFound
+	} else if err == nil {
+		db.cache.add(key, append([]byte(nil), value...))
+	}
+	return value, err
+}
+
+// get looks the key up in the current file and then in the segments from the
+// newest to the oldest one. A deleted key is reported as errDeleted.
+func (db *Db) get(key string) ([]byte, error) {
 	position, ok := db.index[key]
+	if deleted, err := db.deletedByRange(key, position, ok); err != nil {
+		return nil, err
+	} else if deleted {
+		return nil, errDeleted
+	}
 	if !ok {
-		for _, segment := range db.segmentsDb {
-			val, err := segment.Get(key)
-			if err == nil {
-				return val, nil
-			}
-		}
-		return "", ErrNotFound
+		return db.getFromSegments(key)
+	}
+	if db.mapped != nil {
+		return db.mapped.value(position)
 	}
 
-	file, err := os.Open(db.outPath)
+	file, err := openForRead(db.fs, db.outPath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
 	if _, err := file.Seek(position, 0); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	value, err := readValueBytes(reader)
+	if err != nil && err != errDeleted && !isBlobRef(err) {
+		if val, segErr := db.getFromSegments(key); segErr != ErrNotFound {
+			return val, segErr
+		}
+		return nil, err
+	}
+	return value, err
+}
+
+// readRecordAt reads the whole record at the offset of the file.
+func readRecordAt(fs FS, filePath string, offset int64) ([]byte, error) {
+	file, err := openForRead(fs, filePath)
 	if err != nil {
-		for _, segment := range db.segmentsDb {
-			val, err := segment.Get(key)
-			if err == nil {
-				return val, nil
-			}
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(file, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size < 4 {
+		return nil, ErrCorrupted
+	}
+	record := make([]byte, size)
+	copy(record, header[:])
+	if _, err := io.ReadFull(file, record[4:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (db *Db) getFromSegments(key string) ([]byte, error) {
+	for i := len(db.segmentsDb) - 1; i >= 0; i-- {
+		segment := db.segmentsDb[i]
+
+		segment.Lock()
+		val, err := segment.get(key)
+		segment.Unlock()
+
+		if err == nil || err == errDeleted || isBlobRef(err) {
+			return val, err
 		}
-		return "", err
 	}
-	return value, nil
+	return nil, ErrNotFound
 }
 
 func (db *Db) Put(key, value string) error {
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
 	db.Lock()
 	defer db.Unlock()
 
-	e := entry{ key, value }
+	if err := db.checkPut(key, int64(len(value))); err != nil {
+		return err
+	}
 
-	n, err := db.out.Write(e.Encode())
-	if err == nil {
-		db.index[key] = db.outOffset
-		db.outOffset += int64(n)
+	if err := db.appendValue(key, value); err != nil {
+		return err
 	}
 
-	if stat, _ := db.out.Stat(); stat.Size() > MAX_SIZE {
-		db.out.Close()
+	db.notify(ChangeEvent{Key: key, Value: value})
+	return nil
+}
 
-		outNewName := path.Join(db.segPath, fmt.Sprintf("/segment_%d", db.lastSegmentNum))
-		os.Rename(db.outPath, outNewName)
-		os.Remove(db.outPath)
+// PutBytes is Put for binary keys and values.
+func (db *Db) PutBytes(key, value []byte) error {
+	return db.Put(string(key), string(value))
+}
 
-		f, err := os.OpenFile(db.outPath, OS_OPEN_FLAG, OS_OPEN_PERM)
-		if err != nil { 
-			return err 
-		}
+// Delete removes the key by appending a tombstone record, which hides any
+// older value of the key kept in the segments.
+func (db *Db) Delete(key string) error {
+	if err := db.throttle(); err != nil {
+		return err
+	}
 
-		segmentDb, err := NewDb(db.segPath, fmt.Sprintf("/segment_%d", db.lastSegmentNum), true)
-		db.index = make(hashIndex)
-		db.recover()
-		db.segmentsDb = append(db.segmentsDb, segmentDb)
-		db.out = f
-		db.lastSegmentNum++
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.checkKey(key); err != nil {
+		return err
 	}
 
-	return err
+	e := entry{ key, "" }
+
+	if err := db.append(key, e.EncodeTombstone()); err != nil {
+		return err
+	}
+
+	db.notify(ChangeEvent{Key: key, Deleted: true})
+	return nil
 }
 
-func (db *Db) Merge (dbToMerge *Db) error {
-	for key, _ := range dbToMerge.index {
-		if _, err := db.Get(key); err != nil {
-			val, err := dbToMerge.Get(key)
-			if err != nil {
-				if err == io.EOF {
-					if err := os.Remove(dbToMerge.outPath); err != nil {
-						return err
-					}
-				}
+// append writes an encoded record to the current file. If the write fails,
+// the part of the record that made it to the file is cut off, so the file
+// never ends with a broken record.
+func (db *Db) append(key string, record []byte) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	n, err := db.out.Write(record)
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+	db.indexAppended(key, record[:n])
+	return db.rollIfFull()
+}
 
-				return err
-			}
+// indexAppended indexes a record written to the end of the current file.
+func (db *Db) indexAppended(key string, record []byte) {
+	if isRangeTombstone(record) {
+		db.addRange(record)
+		return
+	}
+	if isBlob(record) {
+		db.addBlob(record)
+		return
+	}
+	if hash, ok := referenceHash(record); ok {
+		db.refCounts[hash]++
+	}
+	db.indexRecord(key, int64(len(record)), recordTimestamp(record), isTombstone(record))
+}
 
-			err = db.Put(key, val)
-			if err != nil {
-				return err
-			}
+// appended indexes a record of n bytes written at ts to the end of the current
+// file and moves the file to the segments once it grows over MAX_SIZE.
+// Segments opened for merging are never moved.
+func (db *Db) appended(key string, n int64, ts int64, deleted bool) error {
+	db.indexRecord(key, n, ts, deleted)
+	return db.rollIfFull()
+}
+
+// indexRecord indexes a record of n bytes written at ts to the end of the
+// current file.
+func (db *Db) indexRecord(key string, n int64, ts int64, deleted bool) {
+	db.cache.remove(key)
+	db.index[key] = db.outOffset
+	db.outOffset += n
+	if deleted {
+		db.tombstones[key] = struct{}{}
+	} else {
+		delete(db.tombstones, key)
+	}
+	if ts > db.maxTimestamp {
+		db.maxTimestamp = ts
+	}
+}
+
+// rollIfFull rolls the current file once it grows over MAX_SIZE.
+func (db *Db) rollIfFull() error {
+	defer db.reportUsage()
+	if stat, _ := db.out.Stat(); !db.forMerge && stat.Size() > MAX_SIZE {
+		return db.roll()
+	}
+
+	return nil
+}
+
+// roll moves the current file to the segments and starts an empty one. If
+// the file can't be moved, it stays the current one. A moved file that can't
+// be opened as a segment is quarantined like on recovery; its records are
+// not served until the Db is reopened if even that fails. MergeRoutine is
+// woken up to compact the new segment.
+func (db *Db) roll() error {
+	name := segmentName(db.lastSegmentNum, 0)
+	db.out.Close()
+	if err := db.fs.Rename(db.outPath, path.Join(db.segPath, name)); err != nil {
+		f, openErr := db.fs.OpenFile(db.outPath, OS_OPEN_FLAG, OS_OPEN_PERM)
+		if openErr != nil {
+			return openErr
 		}
+		db.out = f
+		return err
 	}
 
-	if err := os.Remove(dbToMerge.outPath); err != nil {
+	f, err := db.fs.OpenFile(db.outPath, OS_OPEN_FLAG, OS_OPEN_PERM)
+	if err != nil {
 		return err
 	}
+	db.out = f
+	db.lastSegmentNum++
+	db.index = make(hashIndex)
+	db.tombstones = make(map[string]struct{})
+	db.ranges = nil
+	db.blobs = make(map[[sha1.Size]byte]int64)
+	db.refCounts = make(map[[sha1.Size]byte]int)
+	db.outOffset = 0
+	db.maxTimestamp = 0
 
+	segment, err := db.openSegment(db.segPath, name)
+	var corrupted *corruptedError
+	if errors.As(err, &corrupted) {
+		segment, err = db.quarantineSegment(name, corrupted.valid)
+	}
+	if err != nil {
+		return err
+	}
+	db.segmentsDb = append(db.segmentsDb, segment)
+	db.segmentsSize += segment.outOffset
+	db.wakeCompaction()
 	return nil
 }
 
-func (db *Db) MergeRoutine() error {
-	for {
-		files, err := ioutil.ReadDir(db.segPath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(files) < 2 {
-			return nil
+// Merge copies the records of dbToMerge, a file older than the ones of db,
+// that are in force for the keys db holds nothing of, and removes the file of
+// dbToMerge. The file is read sequentially.
+func (db *Db) Merge(dbToMerge *Db) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	run := []*Db{dbToMerge}
+	var (
+		offset    int64
+		appendErr error
+	)
+	err := scanRecords(dbToMerge.fs, dbToMerge.outPath, dbToMerge.outOffset, func(record []byte) {
+		position := offset
+		offset += int64(len(record))
+		if appendErr != nil {
+			return
 		}
 
-		dbToMerge, err := NewDb(db.segPath, files[len(files) - 1].Name(), true)
-		if err != nil {
-			return err
+		key := recordKey(record)
+		db.Lock()
+		defer db.Unlock()
+		switch {
+		case isBatch(record):
+			return
+		case isRangeTombstone(record):
+		case isBlob(record):
+			var hash [sha1.Size]byte
+			copy(hash[:], key)
+			if _, stored := db.blobs[hash]; stored {
+				return
+			}
+		case !inForce(run, 0, key, position, recordTimestamp(record)) || db.holds(key):
+			return
 		}
+		// The record is copied as is, so it keeps its timestamp.
+		appendErr = db.append(key, record)
+	})
+	if err == nil {
+		err = appendErr
+	}
+	if err != nil {
+		return err
+	}
+	return dbToMerge.fs.Remove(dbToMerge.outPath)
+}
 
-		_secondDb, err := NewDb(db.segPath, files[len(files) - 2].Name(), true)
-		if err := dbToMerge.Merge(_secondDb); err != nil {
+// MergeRoutine compacts the segments when the Db is opened and then every 20
+// seconds, or at once when the current file is rolled or a write is held back
+// by the thresholds. It returns when the Db is closed.
+func (db *Db) MergeRoutine() error {
+	for {
+		if _, err := db.compactSegments(); err != nil {
 			return err
 		}
 
-		time.Sleep(time.Duration(20)*time.Second)
+		select {
+		case <-time.After(time.Duration(20) * time.Second):
+		case <-db.compactWake:
+		case <-db.closed:
+			return nil
+		}
 	}
+}
 
-	return nil
+// Compact merges all the segments into one, but for those within the
+// retention window.
+func (db *Db) Compact() error {
+	for {
+		merged, err := db.compactSegments()
+		if err != nil || !merged {
+			return err
+		}
+	}
 }
 
 func (db *Db) SetLastSegmentNumber() error {
-	files, err := ioutil.ReadDir(db.segPath)
+	files, err := db.fs.ReadDir(db.segPath)
 	if err != nil {
 		return err
 	}
 	
-	max := int64(1)
+	// The current file gets the number next to the newest segment, so that
+	// a roll never overwrites an existing segment.
+	db.lastSegmentNum = nextSegmentNumber(files)
+
+	return nil
+}
+
+// sortSegments sorts the segment files from the oldest to the newest. A
+// compaction interrupted by a crash may leave the merged segment next to its
+// newer generation, which then takes precedence.
+func sortSegments(files []os.FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		ni, gi := parseSegmentName(files[i].Name())
+		nj, gj := parseSegmentName(files[j].Name())
+		return ni < nj || ni == nj && gi < gj
+	})
+}
+
+// supersededSegments returns how many of the sorted segment files are
+// replaced by a compacted one. A compaction merges the segments from the
+// oldest one, so its file, of a later generation, replaces all the files
+// sorted before it. They are left only by a crash before their removal.
+func supersededSegments(files []os.FileInfo) int {
+	for i := len(files) - 1; i > 0; i-- {
+		if _, generation := parseSegmentName(files[i].Name()); generation > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// nextSegmentNumber returns the number next to the newest of the segment
+// files.
+func nextSegmentNumber(files []os.FileInfo) int64 {
+	max := int64(0)
 	for _, f := range files {
-		s := strings.Split(f.Name(), "_")
-		if number, _ := strconv.ParseInt(s[1], 10, 64); number > max {
+		if number := segmentNumber(f.Name()); number > max {
 			max = number
 		}
 	}
-
-	db.lastSegmentNum = max
-
-	return nil
+	return max + 1
 }
 
 func (db *Db) recover() error {
-	file, err := os.Open(db.outPath)
-	if err != nil {
-		return err
+	var file io.Reader
+	if db.opts.ReadOnly {
+		// The file is read through the handle kept open, the writer may have
+		// put another one in its place. Refresh reads on from the records
+		// read before.
+		if db.mapped == nil {
+			return io.EOF
+		}
+		file = io.NewSectionReader(db.mapped.file, db.outOffset, math.MaxInt64)
+	} else {
+		f, err := openForRead(db.fs, db.outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file = f
 	}
-	defer file.Close()
 
-	var buf [RECOVER_BUF_SIZE]byte
+	// Only the keys are read, so large values are skipped without being
+	// loaded into memory. The records of a batch are indexed once the whole
+	// batch is read; an incomplete one is cut off with the torn tail.
+	var (
+		batchStart, batchEnd int64
+		batch                []recoveredRecord
+	)
+	tornTail := func() error {
+		if batch != nil {
+			db.outOffset = batchStart
+		}
+		return db.tornTail()
+	}
 	reader := bufio.NewReaderSize(file, RECOVER_BUF_SIZE)
 	for {
-		var (
-			header, data []byte
-			n int
-		)
-
-		header, err = reader.Peek(RECOVER_BUF_SIZE)
-		isError := err != nil && err != io.EOF
-		isEnd := err == io.EOF && len(header) == 0
-		if isError || isEnd {
+		header, err := reader.Peek(8)
+		if err == io.EOF && len(header) == 0 && batch == nil {
+			return err
+		} else if err == io.EOF {
+			return tornTail()
+		} else if err != nil {
 			return err
 		}
 
-		size := binary.LittleEndian.Uint32(header)
-		if size < RECOVER_BUF_SIZE {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+		size := int(binary.LittleEndian.Uint32(header))
+		keySize := int(binary.LittleEndian.Uint32(header[4:]))
+		if keySize+8 > size {
+			return ErrCorrupted
+		}
+		if _, err := reader.Discard(8); err != nil {
+			return err
 		}
 
-		n, err = reader.Read(data)
-		if err != nil {
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return tornTail()
+		}
+		info, err := skipValue(reader, size-keySize-8)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return tornTail()
+		} else if err != nil {
 			return err
-		} else if n != int(size) {
-			return fmt.Errorf("corrupted file")
 		}
 
-		var e entry
-		e.Decode(data)
-		db.index[e.key] = db.outOffset
-		db.outOffset += int64(n)
+		offset := db.outOffset
+		db.outOffset += int64(size)
+		switch {
+		case info.batchSize > 0:
+			if batch != nil {
+				return ErrCorrupted
+			}
+			batchStart, batchEnd = offset, db.outOffset+info.batchSize
+			batch = []recoveredRecord{}
+		case batch != nil:
+			batch = append(batch, recoveredRecord{string(key), info, offset})
+			if db.outOffset > batchEnd {
+				return ErrCorrupted
+			}
+			if db.outOffset == batchEnd {
+				for _, r := range batch {
+					db.indexRecovered(r.key, r.info, r.offset)
+				}
+				batch = nil
+			}
+		default:
+			db.indexRecovered(string(key), info, offset)
+		}
 	}
+}
 
-	return nil
+// recoveredRecord is a record of a batch read by the recovery.
+type recoveredRecord struct {
+	key    string
+	info   recordInfo
+	offset int64
 }
 
-func (db *Db) recoverSegments() error {
-	files, err := ioutil.ReadDir(db.segPath)
-	if err != nil {
-		log.Fatal(err)
+// indexRecovered indexes a record at the offset read by the recovery.
+func (db *Db) indexRecovered(key string, info recordInfo, offset int64) {
+	if info.ts > db.maxTimestamp {
+		db.maxTimestamp = info.ts
 	}
 
-	for _, f := range files {
-		segmentDb, _ := NewDb(db.segPath, f.Name(), true)
-		db.segmentsDb = append(db.segmentsDb, segmentDb)
+	var hash [sha1.Size]byte
+	switch {
+	case info.rangeEnd != nil:
+		db.ranges = append(db.ranges, rangeTombstone{key, *info.rangeEnd, info.ts, offset})
+		return
+	case string(info.hash) == string(blobHash[:]):
+		copy(hash[:], key)
+		db.blobs[hash] = offset
+		return
+	case info.valSize == 0 && isReferenceHash(info.hash):
+		copy(hash[:], info.hash)
+		db.refCounts[hash]++
+	}
+
+	db.index[key] = offset
+	if info.deleted() {
+		db.tombstones[key] = struct{}{}
+	} else {
+		delete(db.tombstones, key)
+	}
+}
+
+// recordInfo describes a record read by skipValue.
+type recordInfo struct {
+	ts      int64
+	hash    []byte
+	valSize int
+	// rangeEnd is set for a range tombstone, batchSize for a batch record.
+	rangeEnd  *string
+	batchSize int64
+}
+
+func (r recordInfo) deleted() bool {
+	return r.valSize == 0 && string(r.hash) == string(tombstoneHash[:])
+}
+
+// skipValue skips the rest of a record after the key, which takes n bytes. The
+// value is read only for a range tombstone, whose range end is returned, and
+// for a batch record, whose batch size is.
+func skipValue(reader *bufio.Reader, n int) (recordInfo, error) {
+	var info recordInfo
+	info.hash = make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, info.hash); err != nil {
+		return info, err
+	}
+	var buf [timestampSize]byte
+	if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+		return info, err
+	}
+	info.valSize = int(binary.LittleEndian.Uint32(buf[:]))
+	if info.valSize > n {
+		return info, ErrCorrupted
+	}
+
+	if string(info.hash) == string(rangeTombstoneHash[:]) {
+		end := make([]byte, info.valSize)
+		if _, err := io.ReadFull(reader, end); err != nil {
+			return info, err
+		}
+		info.rangeEnd = new(string)
+		*info.rangeEnd = string(end)
+	} else if string(info.hash) == string(batchHash[:]) {
+		if info.valSize != 4 {
+			return info, ErrCorrupted
+		}
+		if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+			return info, err
+		}
+		info.batchSize = int64(binary.LittleEndian.Uint32(buf[:4]))
+		if info.batchSize == 0 {
+			return info, ErrCorrupted
+		}
+	} else if _, err := reader.Discard(info.valSize); err != nil {
+		return info, err
+	}
+
+	switch n - sha1.Size - 4 - info.valSize {
+	case 0:
+		return info, nil
+	case timestampSize:
+		if _, err := io.ReadFull(reader, buf[:]); err != nil {
+			return info, err
+		}
+		info.ts = int64(binary.LittleEndian.Uint64(buf[:]))
+		return info, nil
+	default:
+		return info, ErrCorrupted
+	}
+}
+
+// tornTail handles a file ending in the middle of a record, which is left by
+// a crash during a write. The broken record is cut off the current file, as
+// it was never acknowledged; a segment with such a tail is corrupted.
+func (db *Db) tornTail() error {
+	// The tail read by a read-only Db may be a record being written.
+	if db.opts.ReadOnly {
+		return io.EOF
+	}
+	if db.forMerge {
+		return ErrCorrupted
+	}
+	if err := db.out.Truncate(db.outOffset); err != nil {
+		return err
 	}
+	return io.EOF
+}
+
+// recoverSegments opens the segments, oldest first, and reports the progress
+// to the function if it is not nil. The segments are opened in parallel by
+// a pool of RecoveryWorkers; the corrupted ones are quarantined afterwards,
+// one by one.
+func (db *Db) recoverSegments(progress func(recovered, total int)) error {
+	for {
+		files, err := db.fs.ReadDir(db.segPath)
+		if os.IsNotExist(err) && db.opts.ReadOnly {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		sortSegments(files)
+
+		// The compacted records of the superseded segments are in force,
+		// while their tombstones are dropped, so a superseded segment is
+		// never read. The removal of a writable Db finishes the compaction.
+		superseded := supersededSegments(files)
+		if !db.opts.ReadOnly {
+			for _, f := range files[:superseded] {
+				if err := db.fs.Remove(path.Join(db.segPath, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		files = files[superseded:]
+
+		segments, errs := db.openSegments(files, progress)
+		merged := false
+		for i, f := range files {
+			segmentDb, err := segments[i], errs[i]
+			var corrupted *corruptedError
+			if os.IsNotExist(err) && db.opts.ReadOnly {
+				merged = true
+				continue
+			} else if errors.As(err, &corrupted) && !db.opts.ReadOnly {
+				segmentDb, err = db.quarantineSegment(f.Name(), corrupted.valid)
+			}
+			if err != nil {
+				for _, segment := range segments[i+1:] {
+					if segment != nil {
+						segment.Close()
+					}
+				}
+				return err
+			}
+			db.segmentsDb = append(db.segmentsDb, segmentDb)
+		}
+
+		// A segment was compacted after the listing, into a file the listing
+		// may lack, so the segments are listed again.
+		if merged {
+			for _, segment := range db.segmentsDb {
+				segment.Close()
+			}
+			db.segmentsDb = nil
+			continue
+		}
+
+		db.segmentsSize = 0
+		for _, segment := range db.segmentsDb {
+			db.segmentsSize += segment.outOffset
+		}
+		return nil
+	}
+}
+
+// openSegments opens the segment files in parallel. The results are in the
+// order of the files.
+func (db *Db) openSegments(files []os.FileInfo, progress func(recovered, total int)) ([]*Db, []error) {
+	segments := make([]*Db, len(files))
+	errs := make([]error, len(files))
+
+	var (
+		mu        sync.Mutex
+		recovered int
+	)
+	if progress != nil {
+		progress(0, len(files))
+	}
+
+	workers := db.opts.RecoveryWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				segments[i], errs[i] = db.openSegment(db.segPath, files[i].Name())
+				if progress != nil {
+					mu.Lock()
+					recovered++
+					progress(recovered, len(files))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return segments, errs
+}
+
+// openSegment opens a segment file on the file system of db.
+func (db *Db) openSegment(dir, name string) (*Db, error) {
+	return NewDbWithOptions(dir, name, true, Options{FS: db.fs, MmapSegments: db.opts.MmapSegments, ReadOnly: db.opts.ReadOnly})
+}
+
+// segmentName returns the name of the segment file with the number and the
+// generation. A roll makes the generation 0 of a number; a compaction writes
+// the next generation of the newest segment it merges, so that the compacted
+// file never takes the name of a file a follower may be reading.
+func segmentName(number, generation int64) string {
+	if generation == 0 {
+		return fmt.Sprintf("segment_%d", number)
+	}
+	return fmt.Sprintf("segment_%d.%d", number, generation)
+}
+
+// parseSegmentName returns the number and the generation of a segment file.
+func parseSegmentName(name string) (number, generation int64) {
+	s := strings.Split(name, "_")
+	s = strings.SplitN(s[len(s)-1], ".", 2)
+	number, _ = strconv.ParseInt(s[0], 10, 64)
+	if len(s) == 2 {
+		generation, _ = strconv.ParseInt(s[1], 10, 64)
+	}
+	return number, generation
+}
 
-	return err
+func segmentNumber(name string) int64 {
+	number, _ := parseSegmentName(name)
+	return number
 }
@@ -1,6 +1,7 @@
 package datastore
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -95,7 +96,7 @@ func TestDb_Put(t *testing.T) {
 	})
 
 	t.Run("segments tests", func(t *testing.T) {
-		db, err = NewDb(dir, "current-data", false)
+		db, err = NewDbWithOptions(dir, "current-data", false, Options{ManualCompaction: true})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -147,3 +148,74 @@ func TestDb_Put(t *testing.T) {
 	})
 }
 
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, "current-data", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+}
+
+func TestDb_Bytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte{0, 'k', 0xff}
+	value := []byte{0xde, 0xad, 0, 0xbe, 0xef}
+
+	if err := db.PutBytes(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Bad value returned expected %x, got %x", value, got)
+	}
+
+	if _, err := db.GetBytes([]byte{0, 'k'}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a key prefix, got %v", err)
+	}
+}
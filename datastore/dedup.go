@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"time"
+)
+
+// DEDUP_MIN_SIZE is the smallest value stored once for all the keys holding
+// it in the dedup mode. A reference to a smaller value would save too little.
+const DEDUP_MIN_SIZE = 256
+
+// In the dedup mode a value is stored once, in a blob record, and every key
+// holding it gets a reference record. A blob record has the value hash as its
+// key and blobHash instead of the hash; it isn't indexed by its key. A
+// reference record has the real value hash and an empty value, which never
+// happens in a plain record, as the hash of the empty value is fixed.
+var blobHash = func() (hash [sha1.Size]byte) {
+	for i := range hash {
+		hash[i] = 0xff
+	}
+	hash[sha1.Size-1] = 0xfe
+	return hash
+}()
+
+var emptyValueHash = sha1.Sum(nil)
+
+// blobRef is returned by the readers of a reference record. The value is read
+// from the blob record by the Db holding all the files.
+type blobRef struct {
+	hash [sha1.Size]byte
+}
+
+func (r *blobRef) Error() string {
+	return "value is stored in a blob"
+}
+
+func isBlobRef(err error) bool {
+	_, ok := err.(*blobRef)
+	return ok
+}
+
+// isReferenceHash reports whether the hash of a record with an empty value
+// makes it a reference record.
+func isReferenceHash(hash []byte) bool {
+	switch string(hash) {
+	case string(emptyValueHash[:]), string(tombstoneHash[:]), string(rangeTombstoneHash[:]), string(blobHash[:]):
+		return false
+	}
+	return true
+}
+
+// recordHash returns the hash field and the value size of the encoded record.
+func recordHash(record []byte) ([]byte, uint32) {
+	kl := binary.LittleEndian.Uint32(record[4:])
+	return record[kl+8 : kl+8+sha1.Size], binary.LittleEndian.Uint32(record[kl+8+sha1.Size:])
+}
+
+func isBlob(record []byte) bool {
+	hash, _ := recordHash(record)
+	return string(hash) == string(blobHash[:])
+}
+
+// referenceHash returns the hash of the value a reference record refers to.
+func referenceHash(record []byte) ([sha1.Size]byte, bool) {
+	var res [sha1.Size]byte
+	hash, valSize := recordHash(record)
+	if valSize != 0 || !isReferenceHash(hash) {
+		return res, false
+	}
+	copy(res[:], hash)
+	return res, true
+}
+
+// appendValue appends a record of the value of the key. In the dedup mode a
+// large value is written as a reference record, preceded by a blob record if
+// the value isn't stored yet. db must be locked.
+func (db *Db) appendValue(key, value string) error {
+	if !db.opts.Dedup || len(value) < DEDUP_MIN_SIZE {
+		e := entry{key, value}
+		return db.append(key, e.Encode())
+	}
+
+	hash := sha1.Sum([]byte(value))
+	if _, _, ok := db.findBlob(hash); !ok {
+		blob := entry{string(hash[:]), value}
+		if err := db.append(blob.key, blob.encode(blobHash, time.Now().UnixNano())); err != nil {
+			return err
+		}
+	}
+
+	e := entry{key: key}
+	return db.append(key, e.encode(hash, time.Now().UnixNano()))
+}
+
+// addBlob registers a blob record written to the end of the current file.
+func (db *Db) addBlob(record []byte) {
+	var e entry
+	e.Decode(record)
+	var hash [sha1.Size]byte
+	copy(hash[:], e.key)
+
+	db.blobs[hash] = db.outOffset
+	db.outOffset += int64(len(record))
+	if ts := recordTimestamp(record); ts > db.maxTimestamp {
+		db.maxTimestamp = ts
+	}
+}
+
+// findBlob returns the file and the offset of the blob record of the hash.
+func (db *Db) findBlob(hash [sha1.Size]byte) (string, int64, bool) {
+	if offset, ok := db.blobs[hash]; ok {
+		return db.outPath, offset, true
+	}
+	for i := len(db.segmentsDb) - 1; i >= 0; i-- {
+		segment := db.segmentsDb[i]
+		segment.Lock()
+		offset, ok := segment.blobs[hash]
+		segment.Unlock()
+		if ok {
+			return segment.outPath, offset, true
+		}
+	}
+	return "", 0, false
+}
+
+// readBlob returns the value stored in the blob record of the hash.
+func (db *Db) readBlob(hash [sha1.Size]byte) ([]byte, error) {
+	filePath, offset, ok := db.findBlob(hash)
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	record, err := readRecordAt(db.fs, filePath, offset)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(record)
+}
+
+// locateBlob opens the file of the blob record of the hash, positioned at the
+// start of the record.
+func (db *Db) locateBlob(hash [sha1.Size]byte) (File, *bufio.Reader, error) {
+	filePath, offset, ok := db.findBlob(hash)
+	if !ok {
+		return nil, nil, ErrCorrupted
+	}
+	file, err := openForRead(db.fs, filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := file.Seek(offset, 0); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, bufio.NewReader(file), nil
+}
+
+// otherRefs counts the references to every blob in the current file and the
+// segments other than the given ones. db must be locked.
+func (db *Db) otherRefs(skip ...*Db) map[[sha1.Size]byte]int {
+	refs := make(map[[sha1.Size]byte]int)
+	add := func(file *Db) {
+		for _, s := range skip {
+			if s == file {
+				return
+			}
+		}
+		for hash, n := range file.refCounts {
+			refs[hash] += n
+		}
+	}
+	add(db)
+	for _, segment := range db.segmentsDb {
+		add(segment)
+	}
+	return refs
+}
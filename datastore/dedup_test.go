@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDb_Dedup(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	open := func() *Db {
+		db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs, Dedup: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	defer func() { db.Close() }()
+
+	shared := strings.Repeat("s", 1000)
+	dropped := strings.Repeat("d", 1000)
+
+	t.Run("references", func(t *testing.T) {
+		for _, key := range []string{"key_a", "key_b", "key_c"} {
+			if err := db.Put(key, shared); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put("key_d", dropped); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats := db.Stats(); stats.Blobs != 2 || stats.BlobRefs != 4 {
+			t.Errorf("Expected 2 blobs and 4 references, got %d and %d", stats.Blobs, stats.BlobRefs)
+		}
+		if usage := fs.Usage(); usage > 2500 {
+			t.Errorf("Expected the values to be stored once, the files take %d", usage)
+		}
+		checkValues(t, db, map[string]string{"key_a": shared, "key_c": shared, "key_d": dropped})
+
+		r, err := db.GetStream("key_b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(value) != shared {
+			t.Errorf("Bad value streamed: %d bytes, %v", len(value), err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		db = open()
+		checkValues(t, db, map[string]string{"key_a": shared, "key_b": shared, "key_d": dropped})
+		if stats := db.Stats(); stats.Blobs != 2 || stats.BlobRefs != 4 {
+			t.Errorf("Expected 2 blobs and 4 references, got %d and %d", stats.Blobs, stats.BlobRefs)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		db.Put("key_b", "small")
+		db.Delete("key_c")
+		db.Put("key_d", "small")
+		pairs := fillSegments(t, db)
+		// The segments may be compacted as they roll.
+		db.Lock()
+		rolled := db.lastSegmentNum
+		db.Unlock()
+		if rolled < 3 {
+			t.Fatal("Expected several segments")
+		}
+
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.Stats(); stats.Blobs != 1 || stats.BlobRefs != 1 {
+			t.Errorf("Expected 1 blob and 1 reference, got %d and %d", stats.Blobs, stats.BlobRefs)
+		}
+		pairs["key_a"] = shared
+		pairs["key_b"] = "small"
+		checkValues(t, db, pairs)
+
+		db.Close()
+		db = open()
+		if value, err := db.Get("key_a"); err != nil || value != shared {
+			t.Errorf("Bad value after reopening: %d bytes, %v", len(value), err)
+		}
+	})
+}
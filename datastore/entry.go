@@ -5,19 +5,76 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"time"
 )
 
 type entry struct {
 	key, value string
 }
 
+// tombstoneHash is stored instead of the value hash in a record that deletes
+// its key. A real SHA-1 is never all zeroes in practice, so it can't clash
+// with a stored value.
+var tombstoneHash [sha1.Size]byte
+
+var errDeleted = fmt.Errorf("record is deleted")
+
+// Every record ends with the time it was written at, in Unix nanoseconds.
+// Records written before the timestamps were added don't have it; their
+// size tells them apart and they are treated as written at time zero.
+const timestampSize = 8
+
 func (e *entry) Encode() []byte {
+	return e.encode(sha1.Sum([]byte(e.value)), time.Now().UnixNano())
+}
+
+// EncodeTombstone encodes a deletion record for the entry key.
+func (e *entry) EncodeTombstone() []byte {
+	return (&entry{key: e.key}).encode(tombstoneHash, time.Now().UnixNano())
+}
+
+// recordTimestamp returns the time the encoded record was written at.
+func recordTimestamp(record []byte) int64 {
+	kl := binary.LittleEndian.Uint32(record[4:])
+	vl := binary.LittleEndian.Uint32(record[kl+8+sha1.Size:])
+	if uint32(len(record)) < kl+vl+sha1.Size+12+timestampSize {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(record[len(record)-timestampSize:]))
+}
+
+// isTombstone reports whether the encoded record deletes its key.
+func isTombstone(record []byte) bool {
+	kl := binary.LittleEndian.Uint32(record[4:])
+	hash := record[kl+8 : kl+8+sha1.Size]
+	vl := binary.LittleEndian.Uint32(record[kl+8+sha1.Size:])
+	return vl == 0 && string(hash) == string(tombstoneHash[:])
+}
+
+// validRecord reports whether the key and value sizes of the encoded record
+// add up to its length, so that a record read from the network can be
+// decoded without going out of it.
+func validRecord(record []byte) bool {
+	n := uint64(len(record))
+	if n < sha1.Size+12 || uint64(binary.LittleEndian.Uint32(record)) != n {
+		return false
+	}
+	kl := uint64(binary.LittleEndian.Uint32(record[4:]))
+	if kl > n-sha1.Size-12 {
+		return false
+	}
+	vl := uint64(binary.LittleEndian.Uint32(record[kl+8+sha1.Size:]))
+	rest := n - kl - sha1.Size - 12
+	return vl == rest || vl+timestampSize == rest
+}
+
+func (e *entry) encode(hash [sha1.Size]byte, ts int64) []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	hash := sha1.Sum([]byte(e.value))
 	hl := len(hash)
 
-	size := kl + vl + hl + 12
+	size := kl + vl + hl + 12 + timestampSize
 	res := make([]byte, size)
 
 	binary.LittleEndian.PutUint32(res, uint32(size))
@@ -26,6 +83,7 @@ func (e *entry) Encode() []byte {
 	copy(res[kl+8:], string(hash[:]))
 	binary.LittleEndian.PutUint32(res[kl+hl+8:], uint32(vl))
 	copy(res[kl+hl+12:], e.value)
+	binary.LittleEndian.PutUint64(res[kl+hl+12+vl:], uint64(ts))
 
 	return res
 }
@@ -44,47 +102,82 @@ func (e *entry) Decode(input []byte) {
 	e.value = string(valBuf)
 }
 
-func readValue(in *bufio.Reader) (string, error) {
+// readValueHeader skips the key of the record and reads the value hash and
+// size, leaving the reader at the start of the value.
+func readValueHeader(in *bufio.Reader) ([]byte, int, error) {
 	header, err := in.Peek(8)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	_, err = in.Discard(8)
 	if err != nil {
-		return "", err
+		return nil, 0, err
+	}
+
+	// The key of a blob record is its value hash, so a key of the hash size
+	// is kept.
+	var key []byte
+	if keySize == sha1.Size {
+		key = make([]byte, keySize)
+		_, err = io.ReadFull(in, key)
+	} else {
+		_, err = in.Discard(keySize)
 	}
-	
-	hl := len(sha1.Sum([]byte{}))
-	hash := make([]byte, hl)
-	n, err := in.Read(hash)
 	if err != nil {
-		return "", err
+		return nil, 0, err
+	}
+
+	hash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(in, hash); err != nil {
+		return nil, 0, err
 	}
 
 	header, err = in.Peek(4)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 	valSize := int(binary.LittleEndian.Uint32(header))
 	_, err = in.Discard(4)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
 
-	data := make([]byte, valSize)
-	n, err = in.Read(data)
+	if valSize == 0 && string(hash) == string(tombstoneHash[:]) {
+		return nil, 0, errDeleted
+	}
+	if string(hash) == string(blobHash[:]) {
+		return key, valSize, nil
+	}
+	if valSize == 0 && isReferenceHash(hash) {
+		ref := &blobRef{}
+		copy(ref.hash[:], hash)
+		return nil, 0, ref
+	}
+	return hash, valSize, nil
+}
+
+func readValue(in *bufio.Reader) (string, error) {
+	value, err := readValueBytes(in)
+	return string(value), err
+}
+
+func readValueBytes(in *bufio.Reader) ([]byte, error) {
+	hash, valSize, err := readValueHeader(in)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+
+	data := make([]byte, valSize)
+	n, err := io.ReadFull(in, data)
+	if err != nil {
+		return nil, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
 	}
 
 	dataHash := sha1.Sum(data)
 	if string(dataHash[:]) != string(hash) {
-		return "", fmt.Errorf("wrong hash")
+		return nil, fmt.Errorf("wrong hash")
 	}
 
-	return string(data), nil
+	return data, nil
 }
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FaultFS is a MemFS that injects write faults, to test how Db behaves when
+// the disk fails. The faults apply to Write, WriteAt and Rename; truncating a
+// file is always allowed, like freeing space on a full disk.
+type FaultFS struct {
+	*MemFS
+
+	mu         sync.Mutex
+	writeErr   error
+	renameErr  error
+	shortWrite bool
+	capacity   int64
+}
+
+func NewFaultFS() *FaultFS {
+	return &FaultFS{MemFS: NewMemFS(), capacity: -1}
+}
+
+// FailNextWrite makes the next write fail with err without writing anything.
+func (fs *FaultFS) FailNextWrite(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.writeErr = err
+}
+
+// FailNextRename makes the next rename fail with err without renaming.
+func (fs *FaultFS) FailNextRename(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.renameErr = err
+}
+
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	err := fs.renameErr
+	fs.renameErr = nil
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.MemFS.Rename(oldpath, newpath)
+}
+
+// ShortNextWrite makes the next write store only half of its data and return
+// io.ErrShortWrite.
+func (fs *FaultFS) ShortNextWrite() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.shortWrite = true
+}
+
+// SetCapacity limits the total size of the files. Writes over the limit store
+// what fits and fail with ENOSPC. A negative capacity removes the limit.
+func (fs *FaultFS) SetCapacity(capacity int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.capacity = capacity
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+// allow returns how many of n bytes written to the end of a file of the given
+// size may be stored, and the error the write must fail with.
+func (fs *FaultFS) allow(size, end int64, n int) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.writeErr; err != nil {
+		fs.writeErr = nil
+		return 0, err
+	}
+	if fs.shortWrite {
+		fs.shortWrite = false
+		return n / 2, io.ErrShortWrite
+	}
+	if grow := end - size; fs.capacity >= 0 && grow > 0 {
+		if free := fs.capacity - fs.MemFS.Usage(); grow > free {
+			if free < 0 {
+				free = 0
+			}
+			return n - int(grow-free), &os.PathError{Op: "write", Err: syscall.ENOSPC}
+		}
+	}
+	return n, nil
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// The database only appends with Write, so the file grows by len(p).
+	n, err := f.fs.allow(stat.Size(), stat.Size()+int64(len(p)), len(p))
+	if n > 0 {
+		if _, writeErr := f.File.Write(p[:n]); writeErr != nil {
+			return 0, writeErr
+		}
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.fs.allow(stat.Size(), off+int64(len(p)), len(p))
+	if n > 0 {
+		if _, writeErr := f.File.WriteAt(p[:n], off); writeErr != nil {
+			return 0, writeErr
+		}
+	}
+	return n, err
+}
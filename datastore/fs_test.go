@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func newFaultDb(t *testing.T, fs *FaultFS, syncWrites bool) *Db {
+	fs.MkdirAll("/db")
+	db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs, SyncWrites: syncWrites})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func checkValues(t *testing.T, db *Db, pairs map[string]string) {
+	for key, expected := range pairs {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		} else if value != expected {
+			t.Errorf("Bad value returned expected %s, got %s", expected, value)
+		}
+	}
+}
+
+func TestDb_FailedWrites(t *testing.T) {
+	pairs := map[string]string{"key1": "value1", "key2": "value2"}
+
+	for name, fail := range map[string]func(fs *FaultFS){
+		"write error": func(fs *FaultFS) { fs.FailNextWrite(errors.New("io error")) },
+		"short write": func(fs *FaultFS) { fs.ShortNextWrite() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := NewFaultFS()
+			db := newFaultDb(t, fs, false)
+
+			if err := db.Put("key1", "value1"); err != nil {
+				t.Fatal(err)
+			}
+			fail(fs)
+			if err := db.Put("lost", "value"); err == nil {
+				t.Errorf("Expected the put to fail")
+			}
+			if err := db.Put("key2", "value2"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.Get("lost"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a failed put, got %v", err)
+			}
+			checkValues(t, db, pairs)
+
+			db.Close()
+			db = newFaultDb(t, fs, false)
+			defer db.Close()
+			checkValues(t, db, pairs)
+		})
+	}
+}
+
+func TestDb_FailedRoll(t *testing.T) {
+	fs := NewFaultFS()
+	db := newFaultDb(t, fs, false)
+
+	value := strings.Repeat("v", 1000)
+	pairs := make(map[string]string)
+	fs.FailNextRename(errors.New("io error"))
+	var err error
+	for i := 0; err == nil; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		// The record is written before the roll fails.
+		pairs[key] = value
+		err = db.Put(key, value)
+	}
+	if stats := db.Stats(); stats.Segments != 0 {
+		t.Errorf("Expected the file to stay current after a failed roll, got %d segments", stats.Segments)
+	}
+	checkValues(t, db, pairs)
+
+	// The next roll moves the file.
+	for i := 0; db.Stats().Segments == 0; i++ {
+		key := fmt.Sprintf("next_%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		pairs[key] = value
+	}
+	checkValues(t, db, pairs)
+
+	db.Close()
+	db = newFaultDb(t, fs, false)
+	defer db.Close()
+	checkValues(t, db, pairs)
+}
+
+func TestDb_DiskFull(t *testing.T) {
+	fs := NewFaultFS()
+	db := newFaultDb(t, fs, false)
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.SetCapacity(fs.Usage() + 10)
+	err := db.Put("key2", strings.Repeat("v", 100))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected ENOSPC, got %v", err)
+	}
+	if _, err := db.Get("key2"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a failed put, got %v", err)
+	}
+	checkValues(t, db, map[string]string{"key1": "value1"})
+
+	fs.SetCapacity(-1)
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, db, map[string]string{"key1": "value1", "key2": "value2"})
+}
+
+func TestDb_Crash(t *testing.T) {
+	t.Run("synced writes survive", func(t *testing.T) {
+		fs := NewFaultFS()
+		db := newFaultDb(t, fs, true)
+
+		pairs := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			pairs[key] = value
+		}
+
+		fs.Crash()
+		db = newFaultDb(t, fs, true)
+		defer db.Close()
+		checkValues(t, db, pairs)
+	})
+
+	t.Run("unsynced writes are dropped", func(t *testing.T) {
+		fs := NewFaultFS()
+		db := newFaultDb(t, fs, false)
+
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		fs.Crash()
+		db = newFaultDb(t, fs, false)
+		defer db.Close()
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a dropped write, got %v", err)
+		}
+	})
+
+	t.Run("torn record is cut off", func(t *testing.T) {
+		fs := NewFaultFS()
+		db := newFaultDb(t, fs, true)
+
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		// A crash in the middle of a write leaves a part of the record.
+		f, err := fs.OpenFile("/db/current-data", OS_OPEN_FLAG, OS_OPEN_PERM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := entry{"torn", "value"}
+		if _, err := f.Write(e.Encode()[:10]); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		db = newFaultDb(t, fs, true)
+		defer db.Close()
+
+		if _, err := db.Get("torn"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a torn record, got %v", err)
+		}
+		if err := db.Put("key2", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, map[string]string{"key1": "value1", "key2": "value2"})
+	})
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/dir")
+
+	f, err := fs.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY|os.O_APPEND, OS_OPEN_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello "))
+	f.Write([]byte("world"))
+	f.Close()
+
+	if err := fs.Rename("/dir/file", "/dir/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("/dir/file"); !os.IsNotExist(err) {
+		t.Errorf("Expected the old name to be gone, got %v", err)
+	}
+
+	r, err := openForRead(fs, "/dir/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Seek(6, io.SeekStart)
+	data := make([]byte, 10)
+	n, _ := r.Read(data)
+	if string(data[:n]) != "world" {
+		t.Errorf("Bad data read: %s", data[:n])
+	}
+
+	files, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "renamed" || files[0].Size() != 11 {
+		t.Errorf("Unexpected directory entries %v", files)
+	}
+}
@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+)
+
+// Version is a value of a key written at some point in time.
+type Version struct {
+	Value     string
+	Deleted   bool
+	Timestamp time.Time
+}
+
+// History returns the versions of the key kept in the log, from the oldest to
+// the newest. Merging keeps the versions replaced within the retention window
+// only. History reads the whole log, so it suits audits and recovery rather
+// than hot paths. The files are opened under the lock and read without it, up
+// to their sizes at the call, so the other reads and writes go on meanwhile.
+func (db *Db) History(key string) ([]Version, error) {
+	files, ends, err := db.openLog()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var (
+		versions []Version
+		// refs holds the hashes of the values of the reference records by
+		// the index of their versions.
+		refs = make(map[int][sha1.Size]byte)
+	)
+	collect := func(record []byte) {
+		if isBatch(record) {
+			return
+		}
+		if isRangeTombstone(record) {
+			if decodeRangeTombstone(record, 0).covers(key) {
+				versions = append(versions, Version{
+					Deleted:   true,
+					Timestamp: time.Unix(0, recordTimestamp(record)),
+				})
+			}
+			return
+		}
+
+		var e entry
+		e.Decode(record)
+		if e.key != key {
+			return
+		}
+		if hash, ok := referenceHash(record); ok {
+			refs[len(versions)] = hash
+		}
+		versions = append(versions, Version{
+			Value:     e.value,
+			Deleted:   isTombstone(record),
+			Timestamp: time.Unix(0, recordTimestamp(record)),
+		})
+	}
+
+	for i, file := range files {
+		if err := scanFile(file, ends[i], collect); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(refs) > 0 {
+		db.Lock()
+		for i, hash := range refs {
+			value, blobErr := db.readBlob(hash)
+			if blobErr != nil && err == nil {
+				err = blobErr
+			}
+			versions[i].Value = string(value)
+		}
+		db.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Merging copies the range tombstones after the newer records of the
+	// segment, so the log order is not always the time order.
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Timestamp.Before(versions[j].Timestamp)
+	})
+	return versions, nil
+}
+
+// openLog opens the segments and the current file, oldest first, and returns
+// the offsets their records end at, -1 for the end of a segment. The files
+// stay readable when they are merged or rolled meanwhile.
+func (db *Db) openLog() ([]File, []int64, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var (
+		files []File
+		ends  []int64
+	)
+	for _, file := range append(append([]*Db(nil), db.segmentsDb...), db) {
+		f, err := openForRead(db.fs, file.outPath)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+		ends = append(ends, -1)
+	}
+	ends[len(ends)-1] = db.outOffset
+	return files, ends, nil
+}
+
+// GetAt returns the value the key had at the given time.
+func (db *Db) GetAt(key string, at time.Time) (string, error) {
+	versions, err := db.History(key)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- {
+		if v := versions[i]; !v.Timestamp.After(at) {
+			if v.Deleted {
+				return "", ErrNotFound
+			}
+			return v.Value, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// scanRecords calls fn for every record of the file up to the end offset, or
+// up to the end of the file if it is negative.
+func scanRecords(fs FS, filePath string, end int64, fn func(record []byte)) error {
+	file, err := openForRead(fs, filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanFile(file, end, fn)
+}
+
+// scanFile is scanRecords for a file just opened.
+func scanFile(file File, end int64, fn func(record []byte)) error {
+	reader := bufio.NewReaderSize(file, RECOVER_BUF_SIZE)
+	var header [4]byte
+	for offset := int64(0); end < 0 || offset < end; {
+		if _, err := io.ReadFull(reader, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		size := binary.LittleEndian.Uint32(header[:])
+		if size < 4 {
+			return ErrCorrupted
+		}
+		record := make([]byte, size)
+		copy(record, header[:])
+		if _, err := io.ReadFull(reader, record[4:]); err != nil {
+			return err
+		}
+
+		fn(record)
+		offset += int64(len(record))
+	}
+	return nil
+}
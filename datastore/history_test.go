@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	before := time.Now()
+	db.Put("key", "value1")
+	afterFirst := time.Now()
+	db.Put("other", "value")
+	db.Put("key", "value2")
+	afterSecond := time.Now()
+	db.Delete("key")
+
+	versions, err := db.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("Expected 3 versions, got %d", len(versions))
+	}
+	if versions[0].Value != "value1" || versions[1].Value != "value2" || !versions[2].Deleted {
+		t.Errorf("Unexpected versions %+v", versions)
+	}
+	if versions[0].Timestamp.Before(before) || versions[0].Timestamp.After(afterFirst) {
+		t.Errorf("Unexpected timestamp %s", versions[0].Timestamp)
+	}
+
+	for at, expected := range map[time.Time]string{afterFirst: "value1", afterSecond: "value2"} {
+		if value, err := db.GetAt("key", at); err != nil || value != expected {
+			t.Errorf("Bad value returned expected %s, got %s (%v)", expected, value, err)
+		}
+	}
+	for _, at := range []time.Time{before, time.Now()} {
+		if _, err := db.GetAt("key", at); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound at %s, got %v", at, err)
+		}
+	}
+}
+
+func TestDb_Retention(t *testing.T) {
+	for _, retention := range []time.Duration{0, time.Hour} {
+		t.Run(retention.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDbWithOptions(dir, "current-data", false, Options{Retention: retention})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 60000; i++ {
+				db.Put(fmt.Sprintf("very_long_key_%d", i%20000), fmt.Sprintf("value_%d", i))
+			}
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+
+			versions, err := db.History("very_long_key_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := 3
+			if retention == 0 {
+				expected = 1
+			}
+			if len(versions) != expected {
+				t.Errorf("Expected %d versions after compaction, got %d", expected, len(versions))
+			}
+			if value, _ := db.Get("very_long_key_1"); value != "value_40001" {
+				t.Errorf("Bad value returned expected value_40001, got %s", value)
+			}
+		})
+	}
+}
+
+func TestDb_HistoryWhileWriting(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs, Retention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fillSegments(t, db)
+
+	// The writes go on and the files roll while History reads the log.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			db.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("new_%d", i))
+		}
+	}()
+	for {
+		versions, err := db.History("key_0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) == 0 || versions[0].Value == "" {
+			t.Fatalf("Unexpected versions %+v", versions)
+		}
+		select {
+		case <-done:
+			if versions, _ := db.History("key_0"); len(versions) != 2 || versions[1].Value != "new_0" {
+				t.Errorf("Unexpected versions %+v", versions)
+			}
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+var (
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+	ErrQuotaExceeded = fmt.Errorf("disk quota exceeded")
+)
+
+// recordSize returns the size of the record of a key and a value.
+func recordSize(keySize int, valueSize int64) int64 {
+	return int64(keySize+sha1.Size+12+timestampSize) + valueSize
+}
+
+// checkKey checks that the Db is writable and the key size against the limit
+// of the options.
+func (db *Db) checkKey(key string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if max := db.opts.MaxKeySize; max > 0 && len(key) > max {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), max)
+	}
+	return nil
+}
+
+// checkPut checks a put of a value of the given size against the limits of
+// the options. db must be locked.
+func (db *Db) checkPut(key string, size int64) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	if max := db.opts.MaxValueSize; max > 0 && size > max {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, size, max)
+	}
+	return db.checkQuota(recordSize(len(key), size))
+}
+
+// checkQuota checks a write of n bytes against the quota of the options. db
+// must be locked.
+func (db *Db) checkQuota(n int64) error {
+	if quota := db.opts.DiskQuota; quota > 0 {
+		if used := db.totalUsage(); used+n > quota {
+			return fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, used, quota)
+		}
+	}
+	return nil
+}
+
+// usage returns the size of the current file and the segments.
+func (db *Db) usage() int64 {
+	return db.segmentsSize + db.outOffset
+}
+
+// diskUsage holds the usage of a Db and of its buckets, which share the
+// DiskQuota, by the bucket name, the Db itself under "". A bucket that is not
+// opened yet is counted by the size of its files.
+type diskUsage struct {
+	sync.Mutex
+	sizes map[string]int64
+}
+
+// newDiskUsage counts the files of the buckets of the Db in dir.
+func newDiskUsage(fs FS, dir string) (*diskUsage, error) {
+	usage := &diskUsage{sizes: make(map[string]int64)}
+	files, err := fs.ReadDir(path.Join(dir, bucketsDir))
+	if os.IsNotExist(err) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		size, err := dirSize(fs, path.Join(dir, bucketsDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		usage.sizes[f.Name()] = size
+	}
+	return usage, nil
+}
+
+// dirSize returns the size of the files in dir and its subdirectories.
+func dirSize(fs FS, dir string) (int64, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, f := range files {
+		if f.IsDir() {
+			n, err := dirSize(fs, path.Join(dir, f.Name()))
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		} else {
+			size += f.Size()
+		}
+	}
+	return size, nil
+}
+
+// totalUsage returns the usage of the Db and of the other buckets sharing its
+// quota. db must be locked; the other buckets are not locked, their usage is
+// the one they reported last.
+func (db *Db) totalUsage() int64 {
+	total := db.usage()
+	if db.quota == nil {
+		return total
+	}
+	db.quota.Lock()
+	defer db.quota.Unlock()
+	for name, size := range db.quota.sizes {
+		if name != db.bucketName {
+			total += size
+		}
+	}
+	return total
+}
+
+// reportUsage makes the usage of the Db seen by the other buckets. db must be
+// locked.
+func (db *Db) reportUsage() {
+	if db.quota == nil {
+		return
+	}
+	db.quota.Lock()
+	db.quota.sizes[db.bucketName] = db.usage()
+	db.quota.Unlock()
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDb_Limits(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	db, err := NewDbWithOptions("/db", "current-data", false, Options{
+		FS:           fs,
+		MaxKeySize:   8,
+		MaxValueSize: 100,
+		DiskQuota:    300,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("long_key_1", "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Put("key", strings.Repeat("v", 101)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if err := db.PutStream("key", strings.NewReader(strings.Repeat("v", 101)), 101); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge for a stream, got %v", err)
+	}
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 2; i++ {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key", value); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if usage := db.Stats().DiskUsage; usage != fs.Usage() || usage > 300 {
+		t.Errorf("Bad disk usage %d, the files take %d", usage, fs.Usage())
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Errorf("Expected a deletion over the quota to succeed, got %v", err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// So is a transaction of deletions only.
+	for db.Stats().DiskUsage <= 300 {
+		if err := db.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Delete("key")
+		tx.Delete("other")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected deletions in a transaction over the quota to succeed, got %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Delete("key")
+		tx.Put("other", "v")
+		return nil
+	})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for a transaction with a put, got %v", err)
+	}
+}
+
+func TestDb_QuotaOfBuckets(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	opts := Options{FS: fs, DiskQuota: 300}
+	db, err := NewDbWithOptions("/db", "current-data", false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := db.CreateBucket("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 100)
+	if err := db.Put("key", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put("key", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put("key", value); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded in the bucket, got %v", err)
+	}
+	if err := db.Put("key", value); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded in the Db, got %v", err)
+	}
+	db.Close()
+
+	// The buckets not opened yet are counted too.
+	db, err = NewDbWithOptions("/db", "current-data", false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", value); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded after reopening, got %v", err)
+	}
+
+	if err := db.DropBucket("b1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", value); err != nil {
+		t.Errorf("Expected the space of the dropped bucket to be free, got %v", err)
+	}
+}
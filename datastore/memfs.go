@@ -0,0 +1,362 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS kept in memory. Besides the contents of every file it keeps
+// the contents at the last Sync, so that a crash dropping the data not yet
+// synced can be simulated. Directory operations are durable at once.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+type memData struct {
+	data, synced []byte
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{"/": true, ".": true},
+	}
+}
+
+// MkdirAll creates the directory with its parents, like os.MkdirAll.
+func (fs *MemFS) MkdirAll(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for name = path.Clean(name); name != "/" && name != "."; name = path.Dir(name) {
+		fs.dirs[name] = true
+	}
+}
+
+// Usage returns the total size of the files.
+func (fs *MemFS) Usage() int64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var usage int64
+	for _, d := range fs.files {
+		usage += int64(len(d.data))
+	}
+	return usage
+}
+
+// Crash drops the data written after the last Sync of every file.
+func (fs *MemFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, d := range fs.files {
+		d.data = append([]byte(nil), d.synced...)
+	}
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	d, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 || !fs.dirs[path.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{}
+		fs.files[name] = d
+	} else if flag&os.O_TRUNC != 0 {
+		d.data = nil
+	}
+
+	return &memFile{fs: fs, name: name, d: d, flag: flag}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if fs.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	if d, ok := fs.files[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(d.data))}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := fs.files[name]; ok || fs.dirs[name] {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !fs.dirs[path.Dir(name)] {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	fs.dirs[name] = true
+	return nil
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	d, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if !fs.dirs[path.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = d
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		for other := range fs.files {
+			if path.Dir(other) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: os.ErrExist}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dirname = path.Clean(dirname)
+	if !fs.dirs[dirname] {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+
+	var res []os.FileInfo
+	for name, d := range fs.files {
+		if path.Dir(name) == dirname {
+			res = append(res, memFileInfo{name: path.Base(name), size: int64(len(d.data))})
+		}
+	}
+	for name := range fs.dirs {
+		if name != dirname && path.Dir(name) == dirname {
+			res = append(res, memFileInfo{name: path.Base(name), dir: true})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return strings.Compare(res[i].Name(), res[j].Name()) < 0
+	})
+	return res, nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	d      *memData
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) checkWrite() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.offset >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkWrite(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.d.data))
+	}
+	f.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkWrite(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		if end > int64(cap(f.d.data)) {
+			// The file grows by doubling, so that appends take linear time.
+			grown := make([]byte, len(f.d.data), 2*end)
+			copy(grown, f.d.data)
+			f.d.data = grown
+		}
+		// The bytes past the end may be left by a truncation.
+		old := len(f.d.data)
+		f.d.data = f.d.data[:end]
+		for i := old; i < len(f.d.data); i++ {
+			f.d.data[i] = 0
+		}
+	}
+	copy(f.d.data[off:], p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.d.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	return memFileInfo{name: path.Base(f.name), size: int64(len(f.d.data))}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.d.synced = append([]byte(nil), f.d.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.checkWrite(); err != nil {
+		return err
+	}
+	if size < int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.writeAt(nil, size)
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0o700
+	}
+	return OS_OPEN_PERM
+}
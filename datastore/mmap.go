@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// mappedFile reads the records of a sealed segment from its memory mapping.
+// The records appended after the file was mapped, and all the records when
+// the file can't be mapped, are read with ReadAt instead.
+type mappedFile struct {
+	file File
+	data []byte
+}
+
+func openMapped(fs FS, name string, size int64) (*mappedFile, error) {
+	file, err := openForRead(fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed mapping is not an error, the file is just read the slow way.
+	data, _ := mmap(file, size)
+	return &mappedFile{file: file, data: data}, nil
+}
+
+// value returns the value of the record at the offset.
+func (m *mappedFile) value(offset int64) ([]byte, error) {
+	if end := int64(len(m.data)); offset+4 <= end {
+		if size := int64(binary.LittleEndian.Uint32(m.data[offset:])); offset+size <= end {
+			return decodeValue(m.data[offset : offset+size])
+		}
+	}
+
+	var header [4]byte
+	if _, err := m.file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.LittleEndian.Uint32(header[:]))
+	if _, err := m.file.ReadAt(record, offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return decodeValue(record)
+}
+
+func (m *mappedFile) close() error {
+	err := munmap(m.data)
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decodeValue returns a copy of the value of the encoded record, checked
+// against its hash. A deletion is reported as errDeleted.
+func decodeValue(record []byte) ([]byte, error) {
+	if len(record) < 8 {
+		return nil, ErrCorrupted
+	}
+	kl := int64(binary.LittleEndian.Uint32(record[4:]))
+	start := 8 + kl + sha1.Size + 4
+	if start > int64(len(record)) {
+		return nil, ErrCorrupted
+	}
+	hash := record[8+kl : 8+kl+sha1.Size]
+	vl := int64(binary.LittleEndian.Uint32(record[start-4:]))
+	if start+vl > int64(len(record)) {
+		return nil, ErrCorrupted
+	}
+
+	if vl == 0 && string(hash) == string(tombstoneHash[:]) {
+		return nil, errDeleted
+	}
+	if string(hash) == string(blobHash[:]) {
+		hash = record[8 : 8+kl]
+	} else if vl == 0 && isReferenceHash(hash) {
+		ref := &blobRef{}
+		copy(ref.hash[:], hash)
+		return nil, ref
+	}
+	value := record[start : start+vl]
+	if dataHash := sha1.Sum(value); string(dataHash[:]) != string(hash) {
+		return nil, fmt.Errorf("wrong hash")
+	}
+	return append([]byte(nil), value...), nil
+}
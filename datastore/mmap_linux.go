@@ -0,0 +1,26 @@
+package datastore
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// mmap maps the first size bytes of the file to memory for reading. Only
+// the files of the disk can be mapped.
+func mmap(file File, size int64) ([]byte, error) {
+	f, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, fmt.Errorf("file can't be mapped")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
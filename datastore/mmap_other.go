@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package datastore
+
+import "fmt"
+
+// mmap is supported on Linux only, elsewhere the segments are read with
+// ReadAt.
+func mmap(file File, size int64) ([]byte, error) {
+	return nil, fmt.Errorf("mmap is not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fillSegments writes enough keys to roll a few segments and returns them.
+func fillSegments(t testing.TB, db *Db) map[string]string {
+	pairs := make(map[string]string)
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if err := db.Put(key, value+key); err != nil {
+			t.Fatal(err)
+		}
+		pairs[key] = value + key
+	}
+	return pairs
+}
+
+func TestDb_MmapSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, "current-data", false, Options{ManualCompaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := fillSegments(t, db)
+	db.Delete("key_10")
+	delete(pairs, "key_10")
+	db.Close()
+
+	for name, opts := range map[string]Options{
+		"disk":   {MmapSegments: true},
+		"memory": {MmapSegments: true, FS: copyToMemFS(t, dir)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := NewDbWithOptions(dir, "current-data", false, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if db.Stats().Segments < 2 {
+				t.Fatalf("Expected a few segments, got %d", db.Stats().Segments)
+			}
+			checkValues(t, db, pairs)
+			if _, err := db.Get("key_10"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+			}
+
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			checkValues(t, db, pairs)
+		})
+	}
+}
+
+// copyToMemFS copies the files of the Db in dir to a MemFS, which can't be
+// mapped, at the same paths.
+func copyToMemFS(t *testing.T, dir string) *MemFS {
+	fs := NewMemFS()
+	fs.MkdirAll(dir + "/segments")
+	for _, sub := range []string{"", "/segments"} {
+		files, err := ioutil.ReadDir(dir + sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			data, err := ioutil.ReadFile(dir + sub + "/" + f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, fs, dir+sub+"/"+f.Name(), data)
+		}
+	}
+	return fs
+}
+
+func BenchmarkDb_GetSegment(b *testing.B) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	fillSegments(b, db)
+	db.Close()
+
+	for name, opts := range map[string]Options{
+		"bufio": {},
+		"mmap":  {MmapSegments: true},
+	} {
+		b.Run(name, func(b *testing.B) {
+			db, err := NewDbWithOptions(dir, "current-data", false, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// The first keys are in the oldest segment.
+				if _, err := db.Get(fmt.Sprintf("key_%d", i%1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
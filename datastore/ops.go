@@ -0,0 +1,68 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var ErrNotNumber = fmt.Errorf("value is not an integer")
+
+// Incr adds delta to the integer value of the key and returns the result. A
+// missing key counts as 0.
+func (db *Db) Incr(key string, delta int64) (int64, error) {
+	var res int64
+	err := db.modify(key, func(value string, found bool) (string, error) {
+		n := int64(0)
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", fmt.Errorf("%w: %q", ErrNotNumber, value)
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", fmt.Errorf("%w: %d%+d overflows", ErrNotNumber, n, delta)
+		}
+		res = n + delta
+		return strconv.FormatInt(res, 10), nil
+	})
+	return res, err
+}
+
+// Append adds the suffix to the end of the value of the key. A missing key is
+// created with the suffix as its value.
+func (db *Db) Append(key, suffix string) error {
+	return db.modify(key, func(value string, found bool) (string, error) {
+		return value + suffix, nil
+	})
+}
+
+// modify replaces the value of the key with the result of fn, under the lock,
+// so that no other write comes in between.
+func (db *Db) modify(key string, fn func(value string, found bool) (string, error)) error {
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	old, err := db.getCached(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	value, err := fn(string(old), err == nil)
+	if err != nil {
+		return err
+	}
+
+	if err := db.checkPut(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := db.appendValue(key, value); err != nil {
+		return err
+	}
+
+	db.notify(ChangeEvent{Key: key, Value: value})
+	return nil
+}
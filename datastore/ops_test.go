@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestDb_Ops(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("incr", func(t *testing.T) {
+		if n, err := db.Incr("counter", 5); err != nil || n != 5 {
+			t.Errorf("Expected 5 for a new counter, got %d, %v", n, err)
+		}
+		if n, err := db.Incr("counter", -7); err != nil || n != -2 {
+			t.Errorf("Expected -2, got %d, %v", n, err)
+		}
+
+		db.Put("text", "abc")
+		if _, err := db.Incr("text", 1); !errors.Is(err, ErrNotNumber) {
+			t.Errorf("Expected ErrNotNumber, got %v", err)
+		}
+		db.Put("big", "9223372036854775807")
+		if _, err := db.Incr("big", 1); !errors.Is(err, ErrNotNumber) {
+			t.Errorf("Expected ErrNotNumber on overflow, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"text": "abc", "big": "9223372036854775807"})
+	})
+
+	t.Run("append", func(t *testing.T) {
+		if err := db.Append("log", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Append("log", "b"); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, map[string]string{"log": "ab"})
+	})
+
+	t.Run("concurrent incr", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if _, err := db.Incr("shared", 1); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		checkValues(t, db, map[string]string{"shared": "400"})
+	})
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Corrupted files are moved to dir/quarantine, so that they can be inspected
+// and repaired by hand. The records before the damage are put back in place
+// of the file, and the Db keeps working without the rest.
+const quarantineDir = "quarantine"
+
+// corruptedError is returned when a segment is opened with a damaged record.
+// The first valid bytes of the file hold whole records.
+type corruptedError struct {
+	valid int64
+}
+
+func (e *corruptedError) Error() string {
+	return ErrCorrupted.Error()
+}
+
+// quarantineCurrent quarantines the current file, which was recovered up to
+// the damaged record.
+func (db *Db) quarantineCurrent() error {
+	db.out.Close()
+	if err := db.quarantine(db.outPath, db.outOffset); err != nil {
+		return err
+	}
+
+	f, err := db.fs.OpenFile(db.outPath, OS_OPEN_FLAG, OS_OPEN_PERM)
+	if err != nil {
+		return err
+	}
+	db.out = f
+	return nil
+}
+
+// quarantineSegment quarantines a segment and opens what was salvaged of it.
+func (db *Db) quarantineSegment(name string, valid int64) (*Db, error) {
+	if err := db.quarantine(path.Join(db.segPath, name), valid); err != nil {
+		return nil, err
+	}
+	return db.openSegment(db.segPath, name)
+}
+
+// quarantine moves the file to the quarantine and puts back a copy of its
+// first valid bytes. The copy is made before the move, so that a crash never
+// leaves the file missing.
+func (db *Db) quarantine(filePath string, valid int64) error {
+	dir := path.Join(db.dir, quarantineDir)
+	if _, err := db.fs.Stat(dir); os.IsNotExist(err) {
+		if err := db.fs.Mkdir(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	target := path.Join(dir, fmt.Sprintf("%s.%d", path.Base(filePath), time.Now().UnixNano()))
+	salvaged := target + ".salvaged"
+	if err := copyPrefix(db.fs, filePath, salvaged, valid); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(filePath, target); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(salvaged, filePath); err != nil {
+		return err
+	}
+
+	db.quarantined++
+	log.Printf("Corrupted file %s moved to %s, %d bytes salvaged", filePath, target, valid)
+	return nil
+}
+
+func copyPrefix(fs FS, src, dst string, n int64) error {
+	in, err := openForRead(fs, src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, OS_OPEN_PERM)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, n); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func writeFile(t testing.TB, fs FS, name string, parts ...[]byte) {
+	f, err := fs.OpenFile(name, OS_OPEN_FLAG, OS_OPEN_PERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, part := range parts {
+		if _, err := f.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDb_Quarantine(t *testing.T) {
+	fs := NewFaultFS()
+	fs.MkdirAll("/db/segments")
+
+	// A record header with the key longer than the record.
+	badHeader := make([]byte, 8)
+	binary.LittleEndian.PutUint32(badHeader, 8)
+	binary.LittleEndian.PutUint32(badHeader[4:], 100)
+
+	seg1, seg2, torn := entry{"seg1", "value1"}, entry{"seg2", "value2"}, entry{"torn", "value"}
+	writeFile(t, fs, "/db/segments/segment_1", seg1.Encode(), seg2.Encode(), torn.Encode()[:10])
+	cur1, cur2 := entry{"cur1", "value1"}, entry{"cur2", "value2"}
+	writeFile(t, fs, "/db/current-data", cur1.Encode(), badHeader, cur2.Encode())
+
+	db := newFaultDb(t, fs, false)
+	if quarantined := db.Stats().Quarantined; quarantined != 2 {
+		t.Errorf("Expected 2 quarantined files, got %d", quarantined)
+	}
+	checkValues(t, db, map[string]string{"seg1": "value1", "seg2": "value2", "cur1": "value1"})
+	if _, err := db.Get("cur2"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a record after the damage, got %v", err)
+	}
+
+	files, err := fs.ReadDir("/db/quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files in the quarantine, got %v", files)
+	}
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = newFaultDb(t, fs, false)
+	defer db.Close()
+	if quarantined := db.Stats().Quarantined; quarantined != 0 {
+		t.Errorf("Expected the salvaged files to be clean, got %d quarantined", quarantined)
+	}
+	checkValues(t, db, map[string]string{"seg1": "value1", "cur1": "value1", "key": "value"})
+}
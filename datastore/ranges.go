@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"time"
+)
+
+// rangeTombstoneHash is stored instead of the value hash in a record that
+// deletes a range of keys: the keys from the record key, inclusive, to its
+// value, exclusive, or to the last key if the value is empty. Like
+// tombstoneHash, it can't clash with a real SHA-1.
+var rangeTombstoneHash = func() (hash [sha1.Size]byte) {
+	for i := range hash {
+		hash[i] = 0xff
+	}
+	return hash
+}()
+
+// rangeTombstone is a range deletion read from a file. It deletes the keys
+// written before it: the records of the older files and the records of its
+// own file with an earlier timestamp.
+type rangeTombstone struct {
+	start, end string
+	ts         int64
+	offset     int64
+}
+
+func (r rangeTombstone) covers(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
+}
+
+// EncodeRangeTombstone encodes a deletion of the keys from the entry key to
+// the entry value.
+func (e *entry) EncodeRangeTombstone() []byte {
+	return e.encode(rangeTombstoneHash, time.Now().UnixNano())
+}
+
+// isRangeTombstone reports whether the encoded record deletes a range of keys.
+func isRangeTombstone(record []byte) bool {
+	kl := binary.LittleEndian.Uint32(record[4:])
+	return string(record[kl+8:kl+8+sha1.Size]) == string(rangeTombstoneHash[:])
+}
+
+func decodeRangeTombstone(record []byte, offset int64) rangeTombstone {
+	var e entry
+	e.Decode(record)
+	return rangeTombstone{start: e.key, end: e.value, ts: recordTimestamp(record), offset: offset}
+}
+
+// prefixEnd returns the first key after all the keys with the prefix, or an
+// empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// DeleteRange deletes the keys from start, inclusive, to end, exclusive, or to
+// the last key if end is empty. The deletion is a single record however many
+// keys it covers; merging drops the covered values of older segments.
+func (db *Db) DeleteRange(start, end string) error {
+	if end != "" && end <= start {
+		return nil
+	}
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.checkKey(start); err != nil {
+		return err
+	}
+
+	e := entry{start, end}
+	if err := db.append(start, e.EncodeRangeTombstone()); err != nil {
+		return err
+	}
+
+	db.notify(ChangeEvent{Key: start, Deleted: true, Range: true, RangeEnd: end})
+	return nil
+}
+
+// DeletePrefix deletes the keys that start with prefix.
+func (db *Db) DeletePrefix(prefix string) error {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// addRange registers a range tombstone record written to the end of the
+// current file.
+func (db *Db) addRange(record []byte) {
+	r := decodeRangeTombstone(record, db.outOffset)
+	db.ranges = append(db.ranges, r)
+	db.outOffset += int64(len(record))
+	if r.ts > db.maxTimestamp {
+		db.maxTimestamp = r.ts
+	}
+	// Any number of cached values may be deleted.
+	db.cache.purge()
+}
+
+// deletedByRange reports whether a range tombstone of the file deletes the
+// key. The record of the key in the file, if any, is at the position; it is
+// deleted if it was written before the range tombstone.
+func (db *Db) deletedByRange(key string, position int64, inFile bool) (bool, error) {
+	newest, covered := db.newestRange(key)
+	if !covered || !inFile {
+		return covered, nil
+	}
+
+	record, err := readRecordAt(db.fs, db.outPath, position)
+	if err != nil {
+		return false, err
+	}
+	return newest.deletes(recordTimestamp(record), position), nil
+}
+
+// newestRange returns the newest range tombstone of the file covering the key.
+func (db *Db) newestRange(key string) (rangeTombstone, bool) {
+	var (
+		newest  rangeTombstone
+		covered bool
+	)
+	for _, r := range db.ranges {
+		if r.covers(key) && (!covered || r.ts >= newest.ts) {
+			newest, covered = r, true
+		}
+	}
+	return newest, covered
+}
+
+// deletes reports whether the range tombstone deletes the record written at
+// ts at the position of the same file.
+func (r rangeTombstone) deletes(ts, position int64) bool {
+	return r.ts > ts || (r.ts == ts && r.offset > position)
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDb_DeleteRange(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	open := func() *Db {
+		db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	defer func() { db.Close() }()
+
+	for _, key := range []string{"a_1", "a_2", "b_1", "b_2", "b_3", "c_1"} {
+		db.Put(key, "value_"+key)
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		events, cancel := db.Watch("a_")
+		defer cancel()
+		otherEvents, otherCancel := db.Watch("c_")
+		defer otherCancel()
+
+		if err := db.DeletePrefix("a_"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("a_1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if event := <-events; !event.Range || event.Key != "a_" || event.RangeEnd != "a`" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+		select {
+		case event := <-otherEvents:
+			t.Errorf("Unexpected event for another prefix %+v", event)
+		default:
+		}
+
+		db.Put("a_2", "again")
+		checkValues(t, db, map[string]string{"a_2": "again", "b_1": "value_b_1"})
+	})
+
+	t.Run("range", func(t *testing.T) {
+		if err := db.DeleteRange("b_2", "c"); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := db.Scan("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"a_2", "b_1", "c_1"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+
+		versions, err := db.History("b_2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || !versions[1].Deleted {
+			t.Errorf("Expected the deletion in the history, got %+v", versions)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		db.Close()
+		db = open()
+
+		keys, _ := db.Scan("")
+		if !reflect.DeepEqual(keys, []string{"a_2", "b_1", "c_1"}) {
+			t.Errorf("Unexpected keys after reopening %v", keys)
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		value := strings.Repeat("v", 100)
+		for i := 0; i < 20000; i++ {
+			db.Put(fmt.Sprintf("drop_%d", i), value)
+		}
+		db.Put("keep", "value")
+		db.DeletePrefix("drop_")
+		// The range tombstone has to be rolled into a segment to be merged.
+		for i := 0; i < 10000; i++ {
+			db.Put(fmt.Sprintf("fill_%d", i%10), value)
+		}
+
+		// The segments may be compacted as they roll, so the usage is
+		// compared with the size of the deleted values.
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		dropped := int64(20000 * len(value))
+		if stats := db.Stats(); stats.DiskUsage-stats.CurrentSize > dropped/2 {
+			t.Errorf("Expected the deleted values to be dropped, the segments take %d bytes", stats.DiskUsage-stats.CurrentSize)
+		}
+
+		if _, err := db.Get("drop_10"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		checkValues(t, db, map[string]string{"keep": "value", "a_2": "again", "c_1": "value_c_1"})
+		if keys, _ := db.Scan("drop_"); len(keys) != 0 {
+			t.Errorf("Expected no keys, got %d", len(keys))
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A read-only Db never writes to its directory: it doesn't create the current
+// file or the segments directory, doesn't merge and doesn't quarantine. It may
+// be opened next to the process writing the directory. The current file is
+// read through the handle opened with the Db, which stays valid when the
+// writer moves the file to the segments; Refresh picks up the changes.
+
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+
+// checkWritable returns ErrReadOnly for a read-only Db.
+func (db *Db) checkWritable() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// openReadOnly opens a file of a read-only Db. A missing current file is not
+// an error, it is read as an empty one and nil is returned for it.
+func openReadOnly(fs FS, name string, forMerge bool) (File, error) {
+	f, err := openForRead(fs, name)
+	if os.IsNotExist(err) && !forMerge {
+		return nil, nil
+	}
+	return f, err
+}
+
+// Refresh picks up the records written, and the segments rolled and merged,
+// by the writer since the Db was opened or last refreshed. The segments
+// directory is listed anew: only the new segments are opened and the removed
+// ones are closed. The current file is read on from the last record read, or
+// opened anew once the writer rolled it. The opened buckets are refreshed
+// too. Refresh does nothing for a writable Db.
+func (db *Db) Refresh() error {
+	if !db.opts.ReadOnly {
+		return nil
+	}
+
+	db.mergeMu.Lock()
+	for {
+		done, err := db.refresh()
+		if err != nil {
+			db.mergeMu.Unlock()
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	db.mergeMu.Unlock()
+
+	db.Lock()
+	var buckets []*Db
+	for _, bucket := range db.buckets {
+		buckets = append(buckets, bucket)
+	}
+	db.Unlock()
+
+	for _, bucket := range buckets {
+		if err := bucket.Refresh(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh makes one attempt of Refresh. It reports false if the writer
+// changed the segments meanwhile, and then it is to be tried again.
+func (db *Db) refresh() (bool, error) {
+	files, err := db.listSegments()
+	if err != nil {
+		return false, err
+	}
+	next := nextSegmentNumber(files)
+
+	db.Lock()
+	rolled := db.mapped == nil || next > db.lastSegmentNum
+	opened := make(map[string]*Db)
+	for _, segment := range db.segmentsDb {
+		opened[filepath.Base(segment.outPath)] = segment
+	}
+	db.Unlock()
+
+	// The current file is opened after the listing, so that it is either
+	// the file after the listed segments or a file rolled since, which the
+	// listing below tells.
+	var (
+		current  *Db
+		segments []*Db
+		added    []*Db
+	)
+	discard := func() {
+		if current != nil {
+			current.Close()
+		}
+		for _, segment := range added {
+			segment.Close()
+		}
+	}
+	if rolled {
+		opts := db.opts
+		opts.OnRecoveryProgress = nil
+		current, err = NewDbWithOptions(db.dir, filepath.Base(db.outPath), true, opts)
+		if os.IsNotExist(err) {
+			current = nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	for _, f := range files {
+		if segment, ok := opened[f.Name()]; ok {
+			segments = append(segments, segment)
+			continue
+		}
+		segment, err := db.openSegment(db.segPath, f.Name())
+		if os.IsNotExist(err) {
+			// The segment was compacted after the listing.
+			discard()
+			return false, nil
+		} else if err != nil {
+			discard()
+			return false, err
+		}
+		segments = append(segments, segment)
+		added = append(added, segment)
+	}
+
+	again, err := db.listSegments()
+	if err != nil {
+		discard()
+		return false, err
+	}
+	if !sameNames(files, again) {
+		discard()
+		return false, nil
+	}
+
+	db.Lock()
+	var (
+		removed []*Db
+		mapped  *mappedFile
+	)
+	kept := make(map[*Db]bool)
+	for _, segment := range segments {
+		kept[segment] = true
+	}
+	for _, segment := range db.segmentsDb {
+		if !kept[segment] {
+			removed = append(removed, segment)
+		}
+	}
+	db.segmentsDb = segments
+	db.segmentsSize = 0
+	for _, segment := range segments {
+		db.segmentsSize += segment.outOffset
+	}
+
+	if rolled {
+		mapped = db.mapped
+		db.lastSegmentNum = next
+		db.mapped = nil
+		db.index = make(hashIndex)
+		db.tombstones = make(map[string]struct{})
+		db.ranges = nil
+		db.blobs = make(map[[sha1.Size]byte]int64)
+		db.refCounts = make(map[[sha1.Size]byte]int)
+		db.outOffset = 0
+		db.maxTimestamp = 0
+		if current != nil {
+			db.mapped = current.mapped
+			db.index = current.index
+			db.tombstones = current.tombstones
+			db.ranges = current.ranges
+			db.blobs = current.blobs
+			db.refCounts = current.refCounts
+			db.outOffset = current.outOffset
+			db.maxTimestamp = current.maxTimestamp
+		}
+	} else {
+		err = db.recover()
+	}
+	db.cache.purge()
+	db.Unlock()
+
+	if mapped != nil {
+		mapped.close()
+	}
+	for _, segment := range removed {
+		segment.Close()
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return true, nil
+}
+
+// listSegments lists the segment files, oldest first.
+func (db *Db) listSegments() ([]os.FileInfo, error) {
+	files, err := db.fs.ReadDir(db.segPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sortSegments(files)
+	return files[supersededSegments(files):], nil
+}
+
+func sameNames(a, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name() != b[i].Name() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader, err := NewDbWithOptions(dir, "current-data", false, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	t.Run("empty directory", func(t *testing.T) {
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("Expected no files to be created, got %d", len(files))
+		}
+		if _, err := reader.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if err := reader.Put("key", "value"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly for a put, got %v", err)
+		}
+		if err := reader.Delete("key"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly for a deletion, got %v", err)
+		}
+		if err := reader.Compact(); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly for compaction, got %v", err)
+		}
+		if _, err := reader.CreateBucket("bucket"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly for a new bucket, got %v", err)
+		}
+	})
+
+	writer, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	t.Run("refresh", func(t *testing.T) {
+		writer.Put("key", "value")
+		if _, err := reader.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound before a refresh, got %v", err)
+		}
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, reader, map[string]string{"key": "value"})
+	})
+
+	t.Run("roll and merge", func(t *testing.T) {
+		pairs := fillSegments(t, writer)
+		writer.Delete("key")
+
+		// The files opened before are read until the next refresh.
+		checkValues(t, reader, map[string]string{"key": "value"})
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, reader, pairs)
+		if _, err := reader.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+
+		if err := writer.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, reader, map[string]string{"key_1": pairs["key_1"]})
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if segments := reader.Stats().Segments; segments != writer.Stats().Segments {
+			t.Errorf("Expected %d segments, got %d", writer.Stats().Segments, segments)
+		}
+		checkValues(t, reader, pairs)
+	})
+
+	t.Run("incremental refresh", func(t *testing.T) {
+		reader.Lock()
+		segments := append([]*Db(nil), reader.segmentsDb...)
+		offset := reader.outOffset
+		reader.Unlock()
+
+		writer.Put("key", "newer value")
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, reader, map[string]string{"key": "newer value"})
+
+		// The segments are kept open and the current file is read on.
+		reader.Lock()
+		defer reader.Unlock()
+		if len(reader.segmentsDb) != len(segments) {
+			t.Fatalf("Expected %d segments, got %d", len(segments), len(reader.segmentsDb))
+		}
+		for i, segment := range reader.segmentsDb {
+			if segment != segments[i] {
+				t.Errorf("Expected the segment %s to be kept open", segment.outPath)
+			}
+		}
+		if reader.outOffset <= offset {
+			t.Errorf("Expected the current file to be read on from %d, got %d", offset, reader.outOffset)
+		}
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		bucket, err := writer.CreateBucket("bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket.Put("key", "bucket value")
+
+		readBucket, err := reader.Bucket("bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, readBucket, map[string]string{"key": "bucket value"})
+
+		bucket.Put("key", "new value")
+		if err := reader.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, readBucket, map[string]string{"key": "new value"})
+		if err := reader.DropBucket("bucket"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly for dropping a bucket, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_ParallelRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, "current-data", false, Options{ManualCompaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every round overwrites all the keys, so the values are right only if
+	// the segments are put in their order.
+	pairs := make(map[string]string)
+	value := strings.Repeat("v", 100)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 12000; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			pairs[key] = fmt.Sprintf("%s_%d", value, round)
+			if err := db.Put(key, pairs[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	segments := db.Stats().Segments
+	db.Close()
+	if segments < 3 {
+		t.Fatalf("Expected several segments, got %d", segments)
+	}
+
+	var calls [][2]int
+	db, err = NewDbWithOptions(dir, "current-data", false, Options{
+		RecoveryWorkers:  2,
+		ManualCompaction: true,
+		OnRecoveryProgress: func(recovered, total int) {
+			calls = append(calls, [2]int{recovered, total})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(calls) != segments+1 {
+		t.Fatalf("Expected %d progress reports, got %v", segments+1, calls)
+	}
+	for i, call := range calls {
+		if call != [2]int{i, segments} {
+			t.Errorf("Expected progress %d of %d, got %v", i, segments, call)
+		}
+	}
+	if db.Stats().Segments != segments {
+		t.Errorf("Expected %d segments, got %d", segments, db.Stats().Segments)
+	}
+	checkValues(t, db, pairs)
+}
@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// LogPosition points to a record in the log. Segment is the number of the
+// segment file; the current file has the number it will get after the roll,
+// so a position stays valid when the file is moved to the segments.
+// Generation tells the segments of a number apart: a compaction replaces the
+// merged segments with a file of the same number and a newer generation, in
+// which the old offsets point nowhere.
+type LogPosition struct {
+	Segment    int64
+	Generation int64
+	Offset     int64
+}
+
+// ReadLog returns whole records written starting from pos, about limit bytes
+// in total, and the position right after them. When pos is already at the end
+// of the log no records are returned. A segment that was removed by a merge is
+// skipped in favour of the next one, as its records were merged forward; a
+// segment replaced by a compaction is read again from its start, as it holds
+// only the records in force.
+func (db *Db) ReadLog(pos LogPosition, limit int) ([]byte, LogPosition, error) {
+	for {
+		db.Lock()
+		current := db.lastSegmentNum
+		if pos.Segment >= current {
+			defer db.Unlock()
+
+			if pos.Segment > current || pos.Generation != 0 || pos.Offset > db.outOffset {
+				return nil, pos, fmt.Errorf("position %d.%d:%d is ahead of the log", pos.Segment, pos.Generation, pos.Offset)
+			}
+			records, err := readRecords(db.fs, db.outPath, pos.Offset, db.outOffset, limit)
+			pos.Offset += int64(len(records))
+			return records, pos, err
+		}
+		segment := db.logSegment(pos.Segment)
+		if segment == nil {
+			pos = LogPosition{Segment: current}
+			db.Unlock()
+			continue
+		}
+		db.Unlock()
+
+		number, generation := parseSegmentName(path.Base(segment.outPath))
+		if number != pos.Segment || generation != pos.Generation {
+			pos = LogPosition{Segment: number, Generation: generation}
+		}
+		if pos.Offset >= segment.outOffset {
+			pos = LogPosition{Segment: number + 1}
+			continue
+		}
+
+		// The segment is removed if a compaction merges it meanwhile, then
+		// the position is looked up again. A segment still in the log must
+		// not be missing though.
+		records, err := readRecords(db.fs, segment.outPath, pos.Offset, segment.outOffset, limit)
+		if os.IsNotExist(err) && !db.hasSegment(segment) {
+			continue
+		} else if err != nil {
+			return nil, pos, err
+		}
+		pos.Offset += int64(len(records))
+		return records, pos, nil
+	}
+}
+
+// logSegment returns the segment of the log with the number, or the first
+// one after it if there is no such segment, and nil if there are none. Of
+// the generations of a number, the newest is returned. db must be locked.
+func (db *Db) logSegment(number int64) *Db {
+	var res *Db
+	for _, segment := range db.segmentsDb {
+		n, _ := parseSegmentName(path.Base(segment.outPath))
+		if n < number {
+			continue
+		}
+		if res != nil && n != segmentNumber(path.Base(res.outPath)) {
+			break
+		}
+		// The segments are kept oldest first, so a newer generation comes
+		// later.
+		res = segment
+	}
+	return res
+}
+
+// hasSegment reports whether the segment is still in the log.
+func (db *Db) hasSegment(segment *Db) bool {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, s := range db.segmentsDb {
+		if s == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// readRecords reads the records of the file between offset and end, stopping
+// at a record boundary once limit bytes are read. The first record is always
+// returned whole, even if it is larger than the limit, and so is a batch.
+func readRecords(fs FS, filePath string, offset, end int64, limit int) ([]byte, error) {
+	file, err := openForRead(fs, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+
+	var (
+		res      []byte
+		header   [4]byte
+		batchEnd int64
+	)
+	for offset < end && (len(res) == 0 || len(res) < limit || offset < batchEnd) {
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			return res, err
+		}
+		size := binary.LittleEndian.Uint32(header[:])
+		if size < 4 {
+			return res, ErrCorrupted
+		}
+
+		record := make([]byte, size)
+		copy(record, header[:])
+		if _, err := io.ReadFull(file, record[4:]); err != nil {
+			return res, err
+		}
+
+		res = append(res, record...)
+		offset += int64(size)
+		if isBatch(record) {
+			n, err := batchSize(record)
+			if err != nil {
+				return res, err
+			}
+			batchEnd = offset + n
+		}
+	}
+	return res, nil
+}
+
+// ApplyLog writes the records read by ReadLog of another Db, in order. The
+// records of a batch are written at once, as by the commit. The sizes in a
+// record are checked before it is decoded, and a record that doesn't add up
+// fails the rest of the log.
+func (db *Db) ApplyLog(records []byte) error {
+	for len(records) > 0 {
+		if len(records) < 4 {
+			return fmt.Errorf("corrupted log")
+		}
+		size := int64(binary.LittleEndian.Uint32(records))
+		if size < 4 || size > int64(len(records)) || !validRecord(records[:size]) {
+			return fmt.Errorf("corrupted log")
+		}
+		n := size
+		if isBatch(records[:size]) {
+			batch, err := batchSize(records[:size])
+			if err != nil || size+batch > int64(len(records)) || !validBatch(records[size:size+batch]) {
+				return fmt.Errorf("corrupted log")
+			}
+			n += batch
+		}
+
+		db.Lock()
+		var err error
+		if n > size {
+			err = db.applyBatch(records[:size], records[size:n])
+		} else {
+			err = db.applyRecord(records[:size])
+		}
+		db.Unlock()
+		if err != nil {
+			return err
+		}
+
+		records = records[n:]
+	}
+	return nil
+}
+
+// validBatch reports whether the records of a batch are all valid and whole.
+func validBatch(batch []byte) bool {
+	for len(batch) > 0 {
+		if len(batch) < 4 {
+			return false
+		}
+		size := binary.LittleEndian.Uint32(batch)
+		if size < 4 || int64(size) > int64(len(batch)) || !validRecord(batch[:size]) {
+			return false
+		}
+		batch = batch[size:]
+	}
+	return true
+}
+
+// applyRecord appends a record of another Db as it is, to keep its timestamp.
+// db must be locked.
+func (db *Db) applyRecord(record []byte) error {
+	var e entry
+	e.Decode(record)
+	if err := db.append(e.key, record); err != nil {
+		return err
+	}
+	return db.notifyApplied(e, record)
+}
+
+// applyBatch appends the batch record and the records of the batch of another
+// Db in one write, then indexes them. db must be locked.
+func (db *Db) applyBatch(header, batch []byte) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	_, err := db.out.Write(append(append([]byte(nil), header...), batch...))
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+
+	db.outOffset += int64(len(header))
+	for len(batch) > 0 {
+		size := binary.LittleEndian.Uint32(batch)
+		record := batch[:size]
+		var e entry
+		e.Decode(record)
+		db.indexAppended(e.key, record)
+		if err := db.notifyApplied(e, record); err != nil {
+			return err
+		}
+		batch = batch[size:]
+	}
+	return db.rollIfFull()
+}
+
+// notifyApplied sends the event of an applied record of the entry. db must
+// be locked.
+func (db *Db) notifyApplied(e entry, record []byte) error {
+	switch hash, ok := referenceHash(record); {
+	case ok:
+		// A compacted segment has its blobs after the references, so the
+		// value may come later; then it is read on demand.
+		if _, _, found := db.findBlob(hash); !found {
+			db.notify(ChangeEvent{Key: e.key, Streamed: true})
+			return nil
+		}
+		value, err := db.readBlob(hash)
+		if err != nil {
+			return err
+		}
+		db.notify(ChangeEvent{Key: e.key, Value: string(value)})
+	case isRangeTombstone(record):
+		db.notify(ChangeEvent{Key: e.key, Deleted: true, Range: true, RangeEnd: e.value})
+	case !isBlob(record):
+		db.notify(ChangeEvent{Key: e.key, Value: e.value, Deleted: isTombstone(record)})
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Replication(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "test-leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(leaderDir)
+
+	followerDir, err := ioutil.TempDir("", "test-follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	leader, err := NewDb(leaderDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	follower, err := NewDb(followerDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	var pos LogPosition
+	sync := func() {
+		for {
+			records, next, err := leader.ReadLog(pos, 64*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) == 0 {
+				return
+			}
+			if err := follower.ApplyLog(records); err != nil {
+				t.Fatal(err)
+			}
+			pos = next
+		}
+	}
+
+	t.Run("apply records", func(t *testing.T) {
+		leader.Put("key1", "value1")
+		leader.Put("key2", "value2")
+		leader.Delete("key1")
+		sync()
+
+		if _, err := follower.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected deleted key1 on the follower, got %v", err)
+		}
+		if value, err := follower.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("Bad value of key2 on the follower: %s, %v", value, err)
+		}
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		err := leader.Update(func(tx *Tx) error {
+			tx.Put("tx1", "value1")
+			tx.Put("tx2", "value2")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A batch is never split by the limit.
+		records, next, err := leader.ReadLog(pos, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.ApplyLog(records); err != nil {
+			t.Fatal(err)
+		}
+		pos = next
+		checkValues(t, follower, map[string]string{"tx1": "value1", "tx2": "value2"})
+	})
+
+	t.Run("malformed records", func(t *testing.T) {
+		record := (&entry{key: "key", value: "value"}).Encode()
+		for _, corrupt := range []func(r []byte){
+			func(r []byte) { binary.LittleEndian.PutUint32(r[4:], 1<<31) },
+			func(r []byte) { binary.LittleEndian.PutUint32(r[4:], uint32(len(r))) },
+			func(r []byte) { binary.LittleEndian.PutUint32(r[3+8+sha1.Size:], 1<<31) },
+		} {
+			bad := append([]byte(nil), record...)
+			corrupt(bad)
+			if err := follower.ApplyLog(bad); err == nil {
+				t.Error("Expected an error for a malformed record")
+			}
+		}
+
+		batch := append(encodeBatch(len(record)), record[:len(record)-1]...)
+		batch = append(batch, 0)
+		binary.LittleEndian.PutUint32(batch[len(batch)-len(record):], uint32(len(record)+1))
+		if err := follower.ApplyLog(batch); err == nil {
+			t.Error("Expected an error for a malformed batch")
+		}
+		if _, err := follower.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected no key from the malformed records, got %v", err)
+		}
+	})
+
+	t.Run("resume across segments", func(t *testing.T) {
+		for i := 0; i < 30000; i++ {
+			leader.Put(fmt.Sprintf("very_long_key_%d", i), "2222222222")
+		}
+		sync()
+
+		if pos.Segment == 1 {
+			t.Errorf("Expected the position to move past the first segment")
+		}
+		for _, i := range []int{0, 15000, 29999} {
+			key := fmt.Sprintf("very_long_key_%d", i)
+			if _, err := follower.Get(key); err != nil {
+				t.Errorf("Cannot get %s from the follower: %s", key, err)
+			}
+		}
+	})
+}
+
+func TestDb_ReplicationCompaction(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "test-leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(leaderDir)
+
+	followerDir, err := ioutil.TempDir("", "test-follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	leader, err := NewDb(leaderDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	follower, err := NewDb(followerDir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	const keys = 2000
+	for i := 0; i < 25000; i++ {
+		if err := leader.Put(fmt.Sprintf("key_%d", i%keys), fmt.Sprintf("value_%0100d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The follower stops in the middle of the newest segment, which the
+	// compaction then replaces.
+	var pos LogPosition
+	for {
+		leader.Lock()
+		newest := leader.lastSegmentNum - 1
+		leader.Unlock()
+		if pos.Segment == newest && pos.Offset > 0 {
+			break
+		}
+		records, next, err := leader.ReadLog(pos, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.ApplyLog(records); err != nil {
+			t.Fatal(err)
+		}
+		pos = next
+	}
+
+	if err := leader.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	leader.Lock()
+	segments := len(leader.segmentsDb)
+	leader.Unlock()
+	if segments != 1 {
+		t.Fatalf("Expected the segments to be compacted into one, got %d", segments)
+	}
+
+	for {
+		records, next, err := leader.ReadLog(pos, 64*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			break
+		}
+		if err := follower.ApplyLog(records); err != nil {
+			t.Fatal(err)
+		}
+		pos = next
+	}
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		want, _ := leader.Get(key)
+		if value, err := follower.Get(key); err != nil || value != want {
+			t.Errorf("Bad value of %s on the follower: %s, %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Scan returns the sorted keys that start with prefix and are not deleted.
+func (db *Db) Scan(prefix string) ([]string, error) {
+	return db.ScanRange(prefix, prefixEnd(prefix))
+}
+
+// ScanRange returns the sorted keys from start, inclusive, to end, exclusive,
+// or to the last key if end is empty, that are not deleted.
+func (db *Db) ScanRange(start, end string) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.scanRange(start, end, 0)
+}
+
+// ScanLimit is ScanRange returning only the first limit keys, for walking the
+// keys page by page without sorting all of them for every page.
+func (db *Db) ScanLimit(start, end string, limit int) ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.scanRange(start, end, limit)
+}
+
+// scanRange is ScanLimit for a locked db, with no limit if it is zero.
+func (db *Db) scanRange(start, end string, limit int) ([]string, error) {
+	bounds := rangeTombstone{start: start, end: end}
+
+	// The files are applied from the oldest to the newest one, so the last
+	// record of every key decides whether it is alive. The range tombstones
+	// of a file delete the keys of the older files and the older keys of
+	// the file itself.
+	alive := make(map[string]bool)
+	apply := func(file *Db) error {
+		for _, r := range file.ranges {
+			for key := range alive {
+				if r.covers(key) {
+					delete(alive, key)
+				}
+			}
+		}
+		for key, position := range file.index {
+			if !bounds.covers(key) {
+				continue
+			}
+			_, deleted := file.tombstones[key]
+			if !deleted {
+				var err error
+				if deleted, err = file.deletedByRange(key, position, true); err != nil {
+					return err
+				}
+			}
+			alive[key] = !deleted
+		}
+		return nil
+	}
+	for _, segment := range db.segmentsDb {
+		segment.Lock()
+		err := apply(segment)
+		segment.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := apply(db); err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && limit < len(alive) {
+		return firstKeys(alive, limit), nil
+	}
+	keys := make([]string, 0, len(alive))
+	for key, ok := range alive {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// firstKeys returns the sorted limit smallest of the alive keys, keeping
+// them on a heap with the largest one on top.
+func firstKeys(alive map[string]bool, limit int) []string {
+	keys := make(lastKeyHeap, 0, limit)
+	for key, ok := range alive {
+		if !ok {
+			continue
+		}
+		if len(keys) < limit {
+			heap.Push(&keys, key)
+		} else if key < keys[0] {
+			keys[0] = key
+			heap.Fix(&keys, 0)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lastKeyHeap is a heap of keys with the largest one first.
+type lastKeyHeap []string
+
+func (h lastKeyHeap) Len() int            { return len(h) }
+func (h lastKeyHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h lastKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lastKeyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+
+func (h *lastKeyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Enough keys to move the deleted ones to a segment.
+	for i := 0; i < 20000; i++ {
+		db.Put(fmt.Sprintf("very_long_key_%d", i), "value")
+	}
+	db.Put("user:2", "value")
+	db.Put("user:1", "value")
+	db.Put("user:3", "value")
+	db.Delete("very_long_key_7")
+	db.Delete("user:3")
+
+	keys, err := db.Scan("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"user:1", "user:2"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	keys, err = db.Scan("very_long_key_7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1110 || keys[0] != "very_long_key_70" {
+		t.Errorf("Unexpected %d keys starting with %v", len(keys), keys[:1])
+	}
+
+	keys, err = db.ScanLimit("user:", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"user:1", "user:2", "very_long_key_0"}) {
+		t.Errorf("Unexpected limited keys %v", keys)
+	}
+}
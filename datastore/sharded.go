@@ -0,0 +1,302 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const shardsManifest = "shards"
+
+var ErrNotSharded = fmt.Errorf("directory holds a single-shard database, migrate it with MigrateToSharded")
+
+// ShardedDb spreads the keys over several Db instances by their hash, so
+// that writes to different shards don't wait for each other. Every shard
+// lives in its own dir/shard_N directory. The number of shards is stored in
+// the dir/shards manifest and can't be changed after the creation.
+type ShardedDb struct {
+	shards []*Db
+}
+
+func NewShardedDb(dir string, shards int, opts Options) (*ShardedDb, error) {
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+
+	count, err := readShardsManifest(fs, dir)
+	if os.IsNotExist(err) {
+		if _, err := fs.Stat(path.Join(dir, "current-data")); err == nil {
+			return nil, ErrNotSharded
+		}
+		if err := writeShardsManifest(fs, dir, shards); err != nil {
+			return nil, err
+		}
+		count = shards
+	} else if err != nil {
+		return nil, err
+	}
+	if count != shards {
+		return nil, fmt.Errorf("directory holds %d shards, not %d", count, shards)
+	}
+
+	return openShards(fs, dir, shards, opts)
+}
+
+func openShards(fs FS, dir string, shards int, opts Options) (*ShardedDb, error) {
+	sdb := &ShardedDb{}
+	for i := 0; i < shards; i++ {
+		shardDir := path.Join(dir, fmt.Sprintf("shard_%d", i))
+		if _, err := fs.Stat(shardDir); os.IsNotExist(err) {
+			if err := fs.Mkdir(shardDir, os.ModePerm); err != nil {
+				sdb.Close()
+				return nil, err
+			}
+		}
+
+		shard, err := NewDbWithOptions(shardDir, "current-data", false, opts)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, shard)
+	}
+	return sdb, nil
+}
+
+func (sdb *ShardedDb) shard(key string) *Db {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return sdb.shards[h.Sum32()%uint32(len(sdb.shards))]
+}
+
+func (sdb *ShardedDb) Get(key string) (string, error) {
+	return sdb.shard(key).Get(key)
+}
+
+func (sdb *ShardedDb) Put(key, value string) error {
+	return sdb.shard(key).Put(key, value)
+}
+
+func (sdb *ShardedDb) Delete(key string) error {
+	return sdb.shard(key).Delete(key)
+}
+
+// DeleteRange deletes the range of keys in every shard.
+func (sdb *ShardedDb) DeleteRange(start, end string) error {
+	for _, shard := range sdb.shards {
+		if err := shard.DeleteRange(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *ShardedDb) DeletePrefix(prefix string) error {
+	return sdb.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// Scan returns the sorted keys of all the shards that start with prefix.
+func (sdb *ShardedDb) Scan(prefix string) ([]string, error) {
+	var keys []string
+	for _, shard := range sdb.shards {
+		shardKeys, err := shard.Scan(prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stats sums up the stats of the shards.
+func (sdb *ShardedDb) Stats() Stats {
+	var total Stats
+	for _, shard := range sdb.shards {
+		stats := shard.Stats()
+		total.Segments += stats.Segments
+		total.CurrentSize += stats.CurrentSize
+		total.DiskUsage += stats.DiskUsage
+		total.CacheHits += stats.CacheHits
+		total.CacheMisses += stats.CacheMisses
+		total.CacheSize += stats.CacheSize
+		total.Quarantined += stats.Quarantined
+		total.Blobs += stats.Blobs
+		total.BlobRefs += stats.BlobRefs
+		total.Compacting = total.Compacting || stats.Compacting
+		total.CompactedBytes += stats.CompactedBytes
+		total.CompactionBytes += stats.CompactionBytes
+		total.SlowedWrites += stats.SlowedWrites
+		total.StalledWrites += stats.StalledWrites
+	}
+	return total
+}
+
+func (sdb *ShardedDb) Close() error {
+	var err error
+	for _, shard := range sdb.shards {
+		if closeErr := shard.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// MigrateToSharded moves a single-shard database in dir to the given number
+// of shards. The records are copied as they are, keeping their timestamps and
+// deletions. The manifest is written and the old files are removed only after
+// all of them are copied and every key of the old database is found with the
+// same value in its shard, so an interrupted or a failed migration is started
+// over on the next call.
+func MigrateToSharded(dir string, shards int, opts Options) error {
+	fs := opts.FS
+	if fs == nil {
+		fs = osFS{}
+	}
+
+	if _, err := readShardsManifest(fs, dir); err == nil {
+		return fmt.Errorf("directory is already sharded")
+	}
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "shard_") {
+			if err := removeAll(fs, path.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The database is opened read-only with all its segments, so that
+	// ReadLog walks the whole log and nothing is merged meanwhile.
+	single, err := NewDbWithOptions(dir, "current-data", false, Options{FS: fs, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+
+	if shards < 1 {
+		single.Close()
+		return fmt.Errorf("number of shards must be positive")
+	}
+	sdb, err := openShards(fs, dir, shards, opts)
+	if err != nil {
+		single.Close()
+		return err
+	}
+
+	err = copyToShards(single, sdb)
+	if err == nil {
+		err = checkShards(single, sdb)
+	}
+	single.Close()
+	if closeErr := sdb.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeShardsManifest(fs, dir, shards); err != nil {
+		return err
+	}
+
+	if err := fs.Remove(path.Join(dir, "current-data")); err != nil {
+		return err
+	}
+	if _, err := fs.Stat(single.segPath); err == nil {
+		return removeAll(fs, single.segPath)
+	}
+	return nil
+}
+
+func copyToShards(single *Db, sdb *ShardedDb) error {
+	var pos LogPosition
+	for {
+		records, next, err := single.ReadLog(pos, MAX_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		for len(records) > 0 {
+			size := binary.LittleEndian.Uint32(records)
+			if err := copyRecord(sdb, records[:size]); err != nil {
+				return err
+			}
+			records = records[size:]
+		}
+		pos = next
+	}
+}
+
+// checkShards checks that every key of single has the same value in sdb.
+func checkShards(single *Db, sdb *ShardedDb) error {
+	keys, err := single.ScanRange("", "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		want, err := single.Get(key)
+		if err != nil {
+			return err
+		}
+		if value, err := sdb.Get(key); err != nil || value != want {
+			return fmt.Errorf("key %q is not migrated: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// copyRecord applies the record to its shard, or to all the shards for a range
+// deletion and a blob, which may be referred to from any shard. Merging drops
+// the copies of a blob without references. A batch record is dropped, as the
+// records of a batch go to different shards.
+func copyRecord(sdb *ShardedDb, record []byte) error {
+	if isBatch(record) {
+		return nil
+	}
+	if isRangeTombstone(record) || isBlob(record) {
+		for _, shard := range sdb.shards {
+			if err := shard.ApplyLog(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var e entry
+	e.Decode(record)
+	return sdb.shard(e.key).ApplyLog(record)
+}
+
+func readShardsManifest(fs FS, dir string) (int, error) {
+	f, err := openForRead(fs, path.Join(dir, shardsManifest))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func writeShardsManifest(fs FS, dir string, shards int) error {
+	if shards < 1 {
+		return fmt.Errorf("number of shards must be positive")
+	}
+
+	return writeSynced(fs, path.Join(dir, shardsManifest), []byte(strconv.Itoa(shards)))
+}
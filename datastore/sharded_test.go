@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShardedDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		db.Put(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i))
+	}
+	db.Delete("key_5")
+	db.Close()
+
+	if _, err := NewShardedDb(dir, 4, Options{}); err != ErrNotSharded {
+		t.Fatalf("Expected ErrNotSharded, got %v", err)
+	}
+
+	t.Run("migrate", func(t *testing.T) {
+		if err := MigrateToSharded(dir, 4, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(dir + "/current-data"); !os.IsNotExist(err) {
+			t.Errorf("Expected the single-shard file to be removed, got %v", err)
+		}
+		if _, err := NewShardedDb(dir, 3, Options{}); err == nil {
+			t.Errorf("Expected an error for a different number of shards")
+		}
+	})
+
+	sdb, err := NewShardedDb(dir, 4, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	t.Run("get", func(t *testing.T) {
+		if value, err := sdb.Get("key_10"); err != nil || value != "value_10" {
+			t.Errorf("Bad value returned: %s, %v", value, err)
+		}
+		if _, err := sdb.Get("key_5"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+
+	t.Run("put and delete", func(t *testing.T) {
+		if err := sdb.Put("key_5", "restored"); err != nil {
+			t.Fatal(err)
+		}
+		if err := sdb.Delete("key_6"); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := sdb.Get("key_5"); value != "restored" {
+			t.Errorf("Bad value returned: %s", value)
+		}
+		if _, err := sdb.Get("key_6"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		keys, err := sdb.Scan("key_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// key_1 and key_10 to key_19.
+		if len(keys) != 11 || keys[0] != "key_1" || keys[10] != "key_19" {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+
+		keys, _ = sdb.Scan("")
+		if len(keys) != 99 {
+			t.Errorf("Expected 99 keys, got %d", len(keys))
+		}
+	})
+
+	t.Run("spread", func(t *testing.T) {
+		for i, shard := range sdb.shards {
+			if shard.Stats().CurrentSize == 0 {
+				t.Errorf("Shard %d is empty", i)
+			}
+		}
+	})
+}
+
+func TestShardedDb_MigrateSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 3000; i++ {
+		if err := db.Put(fmt.Sprintf("key_%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete("key_5")
+	if segments := db.Stats().Segments; segments == 0 {
+		t.Fatal("Expected the puts to roll segments")
+	}
+	db.Close()
+
+	if err := MigrateToSharded(dir, 4, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	sdb, err := NewShardedDb(dir, 4, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		got, err := sdb.Get(key)
+		if i == 5 {
+			if err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+			}
+		} else if err != nil || got != value {
+			t.Fatalf("Key %s is lost by the migration: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package datastore
+
+// Stats is a snapshot of the Db state.
+type Stats struct {
+	Segments    int
+	CurrentSize int64
+	// DiskUsage is the size of the current file and the segments.
+	DiskUsage int64
+
+	CacheHits   uint64
+	CacheMisses uint64
+	CacheSize   int64
+
+	// Quarantined is the number of corrupted files moved to the quarantine
+	// since the Db was opened. The Db is degraded when it is not zero.
+	Quarantined int
+
+	// Blobs is the number of the values stored in the dedup mode and
+	// BlobRefs the number of the records referring to them.
+	Blobs    int
+	BlobRefs int
+
+	// Compacting is set while the segments are compacted, CompactedBytes of
+	// CompactionBytes of them read so far.
+	Compacting      bool
+	CompactedBytes  int64
+	CompactionBytes int64
+
+	// SlowedWrites and StalledWrites count the writes held back since the
+	// Db was opened, by SlowdownSegments and StallSegments.
+	SlowedWrites  uint64
+	StalledWrites uint64
+}
+
+func (db *Db) Stats() Stats {
+	db.Lock()
+	defer db.Unlock()
+
+	stats := Stats{
+		Segments:    len(db.segmentsDb),
+		CurrentSize: db.outOffset,
+		DiskUsage:   db.usage(),
+		Quarantined: db.quarantined,
+
+		SlowedWrites:  db.slowedWrites,
+		StalledWrites: db.stalledWrites,
+	}
+	for _, file := range append([]*Db{db}, db.segmentsDb...) {
+		stats.Blobs += len(file.blobs)
+		for _, n := range file.refCounts {
+			stats.BlobRefs += n
+		}
+	}
+	db.compaction.Lock()
+	stats.Compacting = db.compaction.running
+	stats.CompactedBytes = db.compaction.done
+	stats.CompactionBytes = db.compaction.total
+	db.compaction.Unlock()
+	if db.cache != nil {
+		stats.CacheHits = db.cache.hits
+		stats.CacheMisses = db.cache.misses
+		stats.CacheSize = db.cache.size
+	}
+	return stats
+}
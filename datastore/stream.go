@@ -0,0 +1,232 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// streamFile is the name prefix of the files in the Db directory the values
+// passed to PutStream are copied to before they are appended.
+const streamFile = "stream-data."
+
+var streamFiles uint64
+
+// PutStream stores a value of the given size read from r. The value is copied
+// in chunks, so it is never held in memory as a whole. It is read into a file
+// of its own first, so that a slow r doesn't hold the other reads and writes
+// up, and then appended to the current file. If r fails or ends before size
+// bytes, nothing is stored.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
+	kl := len(key)
+	recordSize := recordSize(kl, size)
+	if size < 0 || recordSize > math.MaxUint32 {
+		return fmt.Errorf("value size %d is out of range", size)
+	}
+	db.Lock()
+	err := db.checkPut(key, size)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path.Join(db.dir, fmt.Sprintf("%s%d", streamFile, atomic.AddUint64(&streamFiles, 1)))
+	tmp, err := db.fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, OS_OPEN_PERM)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		db.fs.Remove(tmpPath)
+	}()
+	h := sha1.New()
+	if _, err := io.CopyN(io.MultiWriter(tmp, h), r, size); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	header := make([]byte, kl+sha1.Size+12)
+	binary.LittleEndian.PutUint32(header, uint32(recordSize))
+	binary.LittleEndian.PutUint32(header[4:], uint32(kl))
+	copy(header[8:], key)
+	copy(header[kl+8:], h.Sum(nil))
+	binary.LittleEndian.PutUint32(header[kl+sha1.Size+8:], uint32(size))
+
+	db.Lock()
+	defer db.Unlock()
+
+	// The limits are checked again, as other writes went on meanwhile.
+	if err := db.checkPut(key, size); err != nil {
+		return err
+	}
+
+	start := db.outOffset
+	ts := time.Now().UnixNano()
+	var tsBuf [timestampSize]byte
+	binary.LittleEndian.PutUint64(tsBuf[:], uint64(ts))
+	_, err = db.out.Write(header)
+	if err == nil {
+		_, err = io.CopyN(db.out, tmp, size)
+	}
+	if err == nil {
+		_, err = db.out.Write(tsBuf[:])
+	}
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		db.out.Truncate(start)
+		return err
+	}
+
+	if err := db.appended(key, recordSize, ts, false); err != nil {
+		return err
+	}
+
+	db.notify(ChangeEvent{Key: key, Streamed: true})
+	return nil
+}
+
+// removeStreamFiles removes the files of the values a crash left behind in the
+// middle of PutStream.
+func removeStreamFiles(fs FS, dir string) {
+	files, _ := fs.ReadDir(dir)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), streamFile) {
+			fs.Remove(path.Join(dir, f.Name()))
+		}
+	}
+}
+
+// GetStream returns a reader of the key value that reads it from the disk in
+// chunks. The hash is checked as the value is read: the last Read returns an
+// error instead of io.EOF if the value is corrupted.
+func (db *Db) GetStream(key string) (io.ReadCloser, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	file, err := db.locate(key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	hash, valSize, err := readValueHeader(reader)
+	if ref, ok := err.(*blobRef); ok {
+		file.Close()
+		if file, reader, err = db.locateBlob(ref.hash); err == nil {
+			hash, valSize, err = readValueHeader(reader)
+		}
+	}
+	if err != nil {
+		file.Close()
+		if err == errDeleted {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &valueReader{
+		file:     file,
+		in:       reader,
+		left:     int64(valSize),
+		hash:     sha1.New(),
+		expected: hash,
+	}, nil
+}
+
+// locate opens the file holding the latest record of the key, positioned at
+// the start of the record. The file stays readable even if it is moved to the
+// segments or merged after the lock is released.
+func (db *Db) locate(key string) (File, error) {
+	var (
+		filePath string
+		position int64
+	)
+	// The files are looked through from the newest one, and the search stops
+	// at the first record of the key or at a range tombstone deleting it.
+	find := func(file *Db) (bool, error) {
+		pos, ok := file.index[key]
+		if deleted, err := file.deletedByRange(key, pos, ok); err != nil || deleted {
+			return true, err
+		}
+		if ok {
+			filePath, position = file.outPath, pos
+		}
+		return ok, nil
+	}
+
+	found, err := find(db)
+	for i := len(db.segmentsDb) - 1; i >= 0 && !found && err == nil; i-- {
+		segment := db.segmentsDb[i]
+		segment.Lock()
+		found, err = find(segment)
+		segment.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filePath == "" {
+		return nil, ErrNotFound
+	}
+
+	file, err := openForRead(db.fs, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(position, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+type valueReader struct {
+	file     File
+	in       *bufio.Reader
+	left     int64
+	hash     hash.Hash
+	expected []byte
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		if string(r.hash.Sum(nil)) != string(r.expected) {
+			return 0, fmt.Errorf("wrong hash")
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.in.Read(p)
+	r.hash.Write(p[:n])
+	r.left -= int64(n)
+	if err == io.EOF && r.left > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("0123456789abcdef"), 3*MAX_SIZE/16)
+
+	readStream := func(t *testing.T, key string) []byte {
+		r, err := db.GetStream(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := db.PutStream("large", bytes.NewReader(value), int64(len(value))); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("small", "value"); err != nil {
+			t.Fatal(err)
+		}
+
+		if data := readStream(t, "large"); !bytes.Equal(data, value) {
+			t.Errorf("Bad value returned, got %d bytes instead of %d", len(data), len(value))
+		}
+		if data := readStream(t, "small"); string(data) != "value" {
+			t.Errorf("Bad value returned expected value, got %s", data)
+		}
+		if data, err := db.Get("large"); err != nil || data != string(value) {
+			t.Errorf("Cannot get a streamed value: %v", err)
+		}
+	})
+
+	t.Run("short reader", func(t *testing.T) {
+		if err := db.PutStream("short", strings.NewReader("abc"), 10); err == nil {
+			t.Errorf("Expected an error for a short reader")
+		}
+		if _, err := db.GetStream("short"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a failed put, got %v", err)
+		}
+		if data := readStream(t, "small"); string(data) != "value" {
+			t.Errorf("Bad value returned expected value, got %s", data)
+		}
+	})
+
+	t.Run("slow reader", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		done := make(chan error)
+		go func() { done <- db.PutStream("slow", pr, 10) }()
+		pw.Write([]byte("01234"))
+
+		// The other writes go on while the value is uploaded.
+		putDone := make(chan error)
+		go func() { putDone <- db.Put("other", "value") }()
+		select {
+		case err := <-putDone:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Put waited for the streamed value")
+		}
+
+		pw.Write([]byte("56789"))
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if data := readStream(t, "slow"); string(data) != "0123456789" {
+			t.Errorf("Bad value returned expected 0123456789, got %s", data)
+		}
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), streamFile) {
+				t.Errorf("Expected the file %s to be removed", f.Name())
+			}
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, "current-data", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data := readStream(t, "large"); !bytes.Equal(data, value) {
+			t.Errorf("Bad value returned, got %d bytes instead of %d", len(data), len(value))
+		}
+	})
+}
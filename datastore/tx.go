@@ -0,0 +1,217 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MAX_TX_RETRIES is how many times Update runs a transaction that conflicts
+// with other writes before it gives up.
+const MAX_TX_RETRIES = 10
+
+var ErrConflict = fmt.Errorf("transaction conflicts with other writes")
+
+// A commit writes its records after a batch record, which has batchHash
+// instead of the hash and the total size of the records as its value. The
+// recovery indexes the records once the whole batch is read and cuts off
+// a batch left incomplete by a crash. A batch record isn't indexed, and it is
+// dropped by merging, as the records merged are all committed.
+var batchHash = func() (hash [sha1.Size]byte) {
+	for i := range hash {
+		hash[i] = 0xff
+	}
+	hash[sha1.Size-1] = 0xfd
+	return hash
+}()
+
+// encodeBatch encodes the batch record of n bytes of records.
+func encodeBatch(n int) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(n))
+	return (&entry{value: string(size[:])}).encode(batchHash, time.Now().UnixNano())
+}
+
+func isBatch(record []byte) bool {
+	hash, _ := recordHash(record)
+	return string(hash) == string(batchHash[:])
+}
+
+// batchSize returns the size of the records of the batch record.
+func batchSize(record []byte) (int64, error) {
+	var e entry
+	e.Decode(record)
+	if len(e.value) != 4 {
+		return 0, ErrCorrupted
+	}
+	return int64(binary.LittleEndian.Uint32([]byte(e.value))), nil
+}
+
+// Tx is an optimistic transaction. It remembers the versions of the keys it
+// reads and buffers its writes until the commit.
+type Tx struct {
+	db     *Db
+	reads  map[string]uint64
+	writes map[string]*string
+	// rangeVersion is the version of the last range deletion at the first
+	// read. Any range deletion after it is taken as a conflict.
+	rangeVersion uint64
+}
+
+// Update runs fn in a transaction and commits it. The commit fails if a key
+// read by fn was changed since, in which case fn is run again, up to
+// MAX_TX_RETRIES times, and then ErrConflict is returned. Nothing is written
+// if fn returns an error.
+//
+// The writes of a transaction are appended in one batch and become visible
+// at once; a crash in the middle of the commit drops the whole batch.
+func (db *Db) Update(fn func(tx *Tx) error) error {
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
+	for i := 0; i < MAX_TX_RETRIES; i++ {
+		tx := &Tx{
+			db:     db,
+			reads:  make(map[string]uint64),
+			writes: make(map[string]*string),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		if err := tx.commit(); err != ErrConflict {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// Get returns the value of the key, with the writes of the transaction.
+func (tx *Tx) Get(key string) (string, error) {
+	if value, ok := tx.writes[key]; ok {
+		if value == nil {
+			return "", ErrNotFound
+		}
+		return *value, nil
+	}
+
+	tx.db.Lock()
+	defer tx.db.Unlock()
+
+	if len(tx.reads) == 0 {
+		tx.rangeVersion = tx.db.rangeVersion
+	}
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = tx.db.keyVersion(key)
+	}
+	value, err := tx.db.getCached(key)
+	return string(value), err
+}
+
+// GetVersion is Get that also returns the version of the last change of the
+// key, for comparing it to the version seen by an earlier read. The versions
+// are kept in memory: a key not changed since the Db was opened has version 0,
+// and a key not changed lately may get a newer version, as only the versions
+// of the last changes are remembered. The transaction conflicts with any
+// change of the key after the read.
+func (tx *Tx) GetVersion(key string) (string, uint64, error) {
+	value, err := tx.Get(key)
+	return value, tx.reads[key], err
+}
+
+func (tx *Tx) Put(key, value string) {
+	tx.writes[key] = &value
+}
+
+func (tx *Tx) Delete(key string) {
+	tx.writes[key] = nil
+}
+
+func (tx *Tx) commit() error {
+	db := tx.db
+	db.Lock()
+	defer db.Unlock()
+
+	if len(tx.reads) > 0 && db.rangeVersion != tx.rangeVersion {
+		return ErrConflict
+	}
+	for key, version := range tx.reads {
+		if db.keyVersion(key) != version {
+			return ErrConflict
+		}
+	}
+	return db.writeBatch(tx.writes)
+}
+
+// writeBatch writes the values of the keys, nil for a deletion, in one batch
+// and indexes them once the whole batch is written. db must be locked.
+func (db *Db) writeBatch(writes map[string]*string) error {
+	// The keys are written in order, so that the log of a commit doesn't
+	// depend on the map iteration.
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var (
+		batch   []byte
+		records [][]byte
+		puts    bool
+	)
+	for _, key := range keys {
+		e := entry{key: key}
+		var record []byte
+		if value := writes[key]; value == nil {
+			if err := db.checkKey(key); err != nil {
+				return err
+			}
+			record = e.EncodeTombstone()
+		} else {
+			if err := db.checkPut(key, int64(len(*value))); err != nil {
+				return err
+			}
+			e.value = *value
+			record = e.Encode()
+			puts = true
+		}
+		records = append(records, record)
+		batch = append(batch, record...)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	// A batch of deletions only is allowed over the quota, like Delete.
+	header := encodeBatch(len(batch))
+	if puts {
+		if err := db.checkQuota(int64(len(header) + len(batch))); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.out.Write(append(header, batch...))
+	if err == nil && db.syncWrites {
+		err = db.out.Sync()
+	}
+	if err != nil {
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+
+	// The file is rolled after the whole batch is indexed, as all of its
+	// records are in the current file.
+	db.outOffset += int64(len(header))
+	for i, key := range keys {
+		deleted := isTombstone(records[i])
+		db.indexRecord(key, int64(len(records[i])), recordTimestamp(records[i]), deleted)
+		if deleted {
+			db.notify(ChangeEvent{Key: key, Deleted: true})
+		} else {
+			db.notify(ChangeEvent{Key: key, Value: *writes[key]})
+		}
+	}
+	return db.rollIfFull()
+}
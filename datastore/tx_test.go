@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Update(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("from", "100")
+	db.Put("to", "0")
+
+	t.Run("transfer", func(t *testing.T) {
+		err := db.Update(func(tx *Tx) error {
+			from, _ := tx.Get("from")
+			to, _ := tx.Get("to")
+			f, _ := strconv.Atoi(from)
+			d, _ := strconv.Atoi(to)
+			tx.Put("from", strconv.Itoa(f-30))
+			tx.Put("to", strconv.Itoa(d+30))
+			tx.Delete("missing")
+
+			if value, _ := tx.Get("from"); value != "70" {
+				t.Errorf("Expected the transaction to see its write, got %s", value)
+			}
+			if value, _ := db.Get("from"); value != "100" {
+				t.Errorf("Expected the write to be buffered, got %s", value)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, map[string]string{"from": "70", "to": "30"})
+	})
+
+	t.Run("retry on conflict", func(t *testing.T) {
+		runs := 0
+		err := db.Update(func(tx *Tx) error {
+			runs++
+			value, _ := tx.Get("to")
+			if runs == 1 {
+				db.Put("to", "changed")
+			}
+			tx.Put("copy", value)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != 2 {
+			t.Errorf("Expected 2 runs, got %d", runs)
+		}
+		checkValues(t, db, map[string]string{"copy": "changed"})
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		runs := 0
+		err := db.Update(func(tx *Tx) error {
+			runs++
+			tx.Get("to")
+			db.Put("to", strconv.Itoa(runs))
+			tx.Put("lost", "value")
+			return nil
+		})
+		if err != ErrConflict || runs != MAX_TX_RETRIES {
+			t.Errorf("Expected ErrConflict after %d runs, got %v after %d", MAX_TX_RETRIES, err, runs)
+		}
+		if _, err := db.Get("lost"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		abort := errors.New("abort")
+		err := db.Update(func(tx *Tx) error {
+			tx.Put("lost", "value")
+			return abort
+		})
+		if err != abort {
+			t.Errorf("Expected the error of the function, got %v", err)
+		}
+		if _, err := db.Get("lost"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		_, before, err := db.GetVersion("to")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Put("to", "new")
+		value, after, err := db.GetVersion("to")
+		if err != nil || value != "new" || after <= before {
+			t.Errorf("Expected a newer version of the new value, got %q %d after %d, %v", value, after, before, err)
+		}
+
+		err = db.Update(func(tx *Tx) error {
+			if _, version, _ := tx.GetVersion("to"); version != after {
+				t.Errorf("Expected version %d in the transaction, got %d", after, version)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, version, _ := db.GetVersion("never_changed"); version != 0 {
+			t.Errorf("Expected version 0 of an unchanged key, got %d", version)
+		}
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		db.Put("counter", "0")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					err := ErrConflict
+					for err == ErrConflict {
+						err = db.Update(func(tx *Tx) error {
+							value, _ := tx.Get("counter")
+							n, _ := strconv.Atoi(value)
+							tx.Put("counter", strconv.Itoa(n+1))
+							return nil
+						})
+					}
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		checkValues(t, db, map[string]string{"counter": "200"})
+	})
+
+	t.Run("forgotten versions", func(t *testing.T) {
+		_, before, _ := db.GetVersion("to")
+		for i := 0; i < MAX_KEY_VERSIONS; i++ {
+			db.Put("filler_"+strconv.Itoa(i), "value")
+		}
+		if n := len(db.keyVersions); n > MAX_KEY_VERSIONS {
+			t.Errorf("Expected at most %d versions kept, got %d", MAX_KEY_VERSIONS, n)
+		}
+
+		// A forgotten version may only grow, so a change is never missed.
+		_, forgotten, _ := db.GetVersion("to")
+		if forgotten < before {
+			t.Errorf("Expected a version of at least %d, got %d", before, forgotten)
+		}
+		db.Put("to", "newer")
+		if _, after, _ := db.GetVersion("to"); after <= forgotten {
+			t.Errorf("Expected a version above %d after a change, got %d", forgotten, after)
+		}
+	})
+}
+
+func TestDb_TornCommit(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	open := func() *Db {
+		db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open()
+	db.Put("key", "value")
+	err := db.Update(func(tx *Tx) error {
+		tx.Put("a", "1")
+		tx.Put("b", "2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	committed, _ := fs.Stat("/db/current-data")
+
+	// A crash leaves the first record of a batch of two.
+	first := (&entry{"c", "3"}).Encode()
+	second := (&entry{"d", "4"}).Encode()
+	writeFile(t, fs, "/db/current-data", encodeBatch(len(first)+len(second)), first)
+
+	db = open()
+	defer db.Close()
+	checkValues(t, db, map[string]string{"key": "value", "a": "1", "b": "2"})
+	if _, err := db.Get("c"); err != ErrNotFound {
+		t.Errorf("Expected the incomplete batch to be dropped, got %v", err)
+	}
+	if stat, _ := fs.Stat("/db/current-data"); stat.Size() != committed.Size() {
+		t.Errorf("Expected the file to be cut to %d bytes, got %d", committed.Size(), stat.Size())
+	}
+}
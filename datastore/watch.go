@@ -0,0 +1,128 @@
+package datastore
+
+import "strings"
+
+const WATCH_BUF_SIZE = 64
+
+// MAX_KEY_VERSIONS bounds the number of the keys whose versions are kept in
+// memory for the transactions; see keyVersion.
+const MAX_KEY_VERSIONS = 1 << 16
+
+// ChangeEvent describes a single write to the store. Version grows with
+// every write made by the Db instance, so events can be ordered by it.
+// Values written with PutStream are not kept in memory, so their events are
+// marked as Streamed and have no Value; the value is read with GetStream.
+// A range deletion is marked as Range: it deletes the keys from Key to
+// RangeEnd, or to the last key if RangeEnd is empty, and is sent to the
+// subscribers whose prefix overlaps the range.
+type ChangeEvent struct {
+	Key      string
+	Value    string
+	Deleted  bool
+	Streamed bool
+	Range    bool
+	RangeEnd string
+	Version  uint64
+}
+
+type watcher struct {
+	prefix string
+	events chan ChangeEvent
+}
+
+// Watch subscribes to changes of the keys that start with prefix. Every
+// subscriber has a buffer of WATCH_BUF_SIZE events; the writers never wait
+// for it, so a subscriber that falls further behind is dropped and its
+// channel is closed. A closed channel therefore means that events were
+// missed and the caller should re-read the keys it cares about.
+// The returned function cancels the subscription.
+func (db *Db) Watch(prefix string) (<-chan ChangeEvent, func()) {
+	db.Lock()
+	defer db.Unlock()
+
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan ChangeEvent, WATCH_BUF_SIZE),
+	}
+	if db.watchers == nil {
+		db.watchers = make(map[*watcher]struct{})
+	}
+	db.watchers[w] = struct{}{}
+
+	cancel := func() {
+		db.Lock()
+		defer db.Unlock()
+		db.unwatch(w)
+	}
+	return w.events, cancel
+}
+
+func (db *Db) unwatch(w *watcher) {
+	if _, ok := db.watchers[w]; ok {
+		delete(db.watchers, w)
+		close(w.events)
+	}
+}
+
+// notify is called with the lock held after a record has been written.
+func (db *Db) notify(event ChangeEvent) {
+	db.version++
+	event.Version = db.version
+	if db.keyVersions == nil {
+		db.keyVersions = make(map[string]uint64)
+	}
+	if event.Range {
+		db.rangeVersion = db.version
+	} else {
+		db.keyVersions[event.Key] = db.version
+		db.forgetVersions()
+	}
+
+	for w := range db.watchers {
+		if !event.Range && !strings.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		if event.Range && !overlaps(event.Key, event.RangeEnd, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			db.unwatch(w)
+		}
+	}
+}
+
+// keyVersion returns the version of the last change of the key. Only the
+// changes among the last MAX_KEY_VERSIONS ones are remembered; an older key
+// gets the newest of the forgotten versions, which is never below its own.
+// So a version compared after a while may differ with no change of the key,
+// but it always differs after one. db must be locked.
+func (db *Db) keyVersion(key string) uint64 {
+	if version, ok := db.keyVersions[key]; ok {
+		return version
+	}
+	return db.forgottenVersion
+}
+
+// forgetVersions drops the oldest versions once there are MAX_KEY_VERSIONS of
+// them, keeping those of the last MAX_KEY_VERSIONS/2 changes. db must be
+// locked.
+func (db *Db) forgetVersions() {
+	if len(db.keyVersions) < MAX_KEY_VERSIONS {
+		return
+	}
+	db.forgottenVersion = db.version - MAX_KEY_VERSIONS/2
+	for key, version := range db.keyVersions {
+		if version <= db.forgottenVersion {
+			delete(db.keyVersions, key)
+		}
+	}
+}
+
+// overlaps reports whether the range from start to end has keys with the
+// prefix.
+func overlaps(start, end, prefix string) bool {
+	prefixEnd := prefixEnd(prefix)
+	return (prefixEnd == "" || start < prefixEnd) && (end == "" || prefix < end)
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, "current-data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("put and delete events", func(t *testing.T) {
+		events, cancel := db.Watch("user:")
+		defer cancel()
+
+		if err := db.Put("other", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("user:1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("user:1"); err != nil {
+			t.Fatal(err)
+		}
+
+		put := <-events
+		if put.Key != "user:1" || put.Value != "value1" || put.Deleted {
+			t.Errorf("Unexpected put event %+v", put)
+		}
+		del := <-events
+		if del.Key != "user:1" || !del.Deleted {
+			t.Errorf("Unexpected delete event %+v", del)
+		}
+		if del.Version <= put.Version {
+			t.Errorf("Versions must grow (%d after %d)", del.Version, put.Version)
+		}
+	})
+
+	t.Run("slow consumer", func(t *testing.T) {
+		events, cancel := db.Watch("")
+		defer cancel()
+
+		for i := 0; i < WATCH_BUF_SIZE+1; i++ {
+			if err := db.Put("key", "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n := 0
+		for range events {
+			n++
+		}
+		if n != WATCH_BUF_SIZE {
+			t.Errorf("Expected %d buffered events before the channel is closed, got %d", WATCH_BUF_SIZE, n)
+		}
+	})
+}
@@ -0,0 +1,380 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A stream is an append-only sequence of values, each under an ID one greater
+// than the one before, starting from 1. The entries are stored as keys named
+// streamKey, so they get merged, replicated and deleted like any other key,
+// and the last ID as a key named streamIDKey, so that the IDs of the deleted
+// entries are not given out again. A consumer group shares the entries out
+// between its consumers: its last handed out ID is kept as a key named
+// groupKey, and the entries handed out and not acknowledged yet as keys named
+// pendingKey holding their consumers. The names are prefixed with a zero
+// byte, which the stream, group and consumer names can't contain.
+
+// STREAM_CLAIM_TIMEOUT is how long an entry stays with the consumer it was
+// handed out to without being acknowledged before another consumer of the
+// group may take it.
+const STREAM_CLAIM_TIMEOUT = 5 * time.Minute
+
+// STREAM_READ_LIMIT is the most entries XReadGroup hands out at once, as
+// they are written down in one batch.
+const STREAM_READ_LIMIT = 1000
+
+var ErrStreamName = fmt.Errorf("stream, group and consumer names must be non-empty and must not contain zero bytes")
+
+// StreamEntry is a value of a stream with its ID.
+type StreamEntry struct {
+	ID    uint64
+	Value string
+}
+
+// streamGroup is the state of a consumer group, read from its keys on the
+// first use and then kept up to date in memory.
+type streamGroup struct {
+	// delivered is the ID of the last entry handed out to the group.
+	delivered uint64
+	// pending holds the entries handed out and not acknowledged yet by ID.
+	pending map[uint64]pendingEntry
+}
+
+type pendingEntry struct {
+	consumer string
+	// handedOut is the time the entry was last handed out, or the group was
+	// read from its keys, for the claims of the other consumers.
+	handedOut time.Time
+}
+
+func checkStreamName(name string) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return ErrStreamName
+	}
+	return nil
+}
+
+// streamPrefix is the prefix of the keys of the stream entries. The IDs are
+// padded, so the keys are sorted by ID.
+func streamPrefix(stream string) string {
+	return "\x00stream\x00" + stream + "\x00"
+}
+
+func streamKey(stream string, id uint64) string {
+	return fmt.Sprintf("%s%020d", streamPrefix(stream), id)
+}
+
+func streamIDKey(stream string) string {
+	return "\x00streamid\x00" + stream
+}
+
+func groupKey(stream, group string) string {
+	return "\x00group\x00" + stream + "\x00" + group
+}
+
+func pendingPrefix(stream, group string) string {
+	return "\x00pending\x00" + stream + "\x00" + group + "\x00"
+}
+
+func pendingKey(stream, group string, id uint64) string {
+	return fmt.Sprintf("%s%020d", pendingPrefix(stream, group), id)
+}
+
+// lastStreamID returns the ID of the last entry added to the stream, 0 if
+// there is none. It is looked up once and then kept up to date by XAdd. db
+// must be locked.
+func (db *Db) lastStreamID(stream string) (uint64, error) {
+	if id, ok := db.streamIDs[stream]; ok {
+		return id, nil
+	}
+
+	id, err := db.storedStreamID(stream)
+	if err != nil {
+		return 0, err
+	}
+	if db.streamIDs == nil {
+		db.streamIDs = make(map[string]uint64)
+	}
+	db.streamIDs[stream] = id
+	return id, nil
+}
+
+// storedStreamID reads the last ID of the stream from its key. The streams
+// added to before the key was kept are scanned for their last entry instead.
+// db must be locked.
+func (db *Db) storedStreamID(stream string) (uint64, error) {
+	value, err := db.getCached(streamIDKey(stream))
+	if err == nil {
+		id, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return 0, ErrCorrupted
+		}
+		return id, nil
+	} else if err != ErrNotFound {
+		return 0, err
+	}
+
+	prefix := streamPrefix(stream)
+	keys, err := db.scanRange(prefix, prefixEnd(prefix), 0)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(keys[len(keys)-1], prefix), 10, 64)
+	if err != nil {
+		return 0, ErrCorrupted
+	}
+	return id, nil
+}
+
+// XAdd appends the value to the stream and returns its ID. The entry and the
+// last ID of the stream are written in one batch.
+func (db *Db) XAdd(stream, value string) (uint64, error) {
+	if err := checkStreamName(stream); err != nil {
+		return 0, err
+	}
+	if err := db.throttle(); err != nil {
+		return 0, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	last, err := db.lastStreamID(stream)
+	if err != nil {
+		return 0, err
+	}
+	id := last + 1
+	idValue := strconv.FormatUint(id, 10)
+	err = db.writeBatch(map[string]*string{
+		streamKey(stream, id): &value,
+		streamIDKey(stream):   &idValue,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	db.streamIDs[stream] = id
+	return id, nil
+}
+
+// XRange returns up to count entries of the stream from the ID, inclusive, in
+// the order of their IDs. All the entries from the ID are returned if count is
+// not positive. The entries are looked up by their IDs, so a read costs one
+// lookup for every entry returned or deleted.
+func (db *Db) XRange(stream string, fromID uint64, count int) ([]StreamEntry, error) {
+	if err := checkStreamName(stream); err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	// A follower doesn't add to the streams, so only the stored last ID is
+	// up to date there.
+	last, ok := db.streamIDs[stream]
+	if !ok {
+		var err error
+		if last, err = db.storedStreamID(stream); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []StreamEntry
+	for id := fromID; id <= last && (count <= 0 || len(entries) < count); id++ {
+		if id == 0 {
+			continue
+		}
+		value, err := db.getCached(streamKey(stream, id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, StreamEntry{id, string(value)})
+	}
+	return entries, nil
+}
+
+// XReadGroup hands out up to count entries of the stream to the consumer of
+// the group, STREAM_READ_LIMIT if count is not positive or larger. The consumer
+// gets the entries it was handed out before and hasn't acknowledged first,
+// then the ones the other consumers have held for longer than
+// STREAM_CLAIM_TIMEOUT, and then the entries not handed out to the group yet,
+// from the start of the stream for a new group. So every entry goes to one
+// consumer at a time, and at least once until XAck acknowledges it.
+func (db *Db) XReadGroup(stream, group, consumer string, count int) ([]StreamEntry, error) {
+	for _, name := range []string{stream, group, consumer} {
+		if err := checkStreamName(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.throttle(); err != nil {
+		return nil, err
+	}
+	if count <= 0 || count > STREAM_READ_LIMIT {
+		count = STREAM_READ_LIMIT
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	g, err := db.streamGroup(stream, group)
+	if err != nil {
+		return nil, err
+	}
+	last, err := db.lastStreamID(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		entries []StreamEntry
+		taken   []uint64
+		dropped []uint64
+	)
+	writes := make(map[string]*string)
+	full := func() bool {
+		return len(entries) >= count
+	}
+	take := func(id uint64) error {
+		value, err := db.getCached(streamKey(stream, id))
+		if err != nil {
+			return err
+		}
+		entries = append(entries, StreamEntry{id, string(value)})
+		taken = append(taken, id)
+		if p, ok := g.pending[id]; !ok || p.consumer != consumer {
+			writes[pendingKey(stream, group, id)] = &consumer
+		}
+		return nil
+	}
+
+	now := time.Now()
+	var ids []uint64
+	for id, p := range g.pending {
+		if p.consumer == consumer || now.Sub(p.handedOut) > STREAM_CLAIM_TIMEOUT {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		// The own entries of the consumer come before the claimed ones.
+		own := g.pending[ids[i]].consumer == consumer
+		if own != (g.pending[ids[j]].consumer == consumer) {
+			return own
+		}
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		if full() {
+			break
+		}
+		if err := take(id); err == ErrNotFound {
+			// A deleted entry is not handed out any more.
+			dropped = append(dropped, id)
+			writes[pendingKey(stream, group, id)] = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	delivered := g.delivered
+	for ; delivered < last && !full(); delivered++ {
+		if err := take(delivered + 1); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	if delivered != g.delivered {
+		value := strconv.FormatUint(delivered, 10)
+		writes[groupKey(stream, group)] = &value
+	}
+
+	if err := db.writeBatch(writes); err != nil {
+		return nil, err
+	}
+	g.delivered = delivered
+	for _, id := range taken {
+		g.pending[id] = pendingEntry{consumer, now}
+	}
+	for _, id := range dropped {
+		delete(g.pending, id)
+	}
+	return entries, nil
+}
+
+// XAck acknowledges the entry of the ID handed out to the consumer group, so
+// that it is not handed out again. Acknowledging an entry that is not
+// pending does nothing.
+func (db *Db) XAck(stream, group string, id uint64) error {
+	if err := checkStreamName(stream); err != nil {
+		return err
+	}
+	if err := checkStreamName(group); err != nil {
+		return err
+	}
+	if err := db.throttle(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	g, err := db.streamGroup(stream, group)
+	if err != nil {
+		return err
+	}
+	if _, ok := g.pending[id]; !ok {
+		return nil
+	}
+	if err := db.writeBatch(map[string]*string{pendingKey(stream, group, id): nil}); err != nil {
+		return err
+	}
+	delete(g.pending, id)
+	return nil
+}
+
+// streamGroup returns the state of the consumer group, reading it from its
+// keys the first time. db must be locked.
+func (db *Db) streamGroup(stream, group string) (*streamGroup, error) {
+	key := groupKey(stream, group)
+	if g, ok := db.streamGroups[key]; ok {
+		return g, nil
+	}
+
+	g := &streamGroup{pending: make(map[uint64]pendingEntry)}
+	value, err := db.getCached(key)
+	if err == nil {
+		if g.delivered, err = strconv.ParseUint(string(value), 10, 64); err != nil {
+			return nil, ErrCorrupted
+		}
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	prefix := pendingPrefix(stream, group)
+	keys, err := db.scanRange(prefix, prefixEnd(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		id, err := strconv.ParseUint(strings.TrimPrefix(key, prefix), 10, 64)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+		consumer, err := db.getCached(key)
+		if err != nil {
+			return nil, err
+		}
+		g.pending[id] = pendingEntry{string(consumer), now}
+	}
+
+	if db.streamGroups == nil {
+		db.streamGroups = make(map[string]*streamGroup)
+	}
+	db.streamGroups[key] = g
+	return g, nil
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDb_Streams(t *testing.T) {
+	fs := NewMemFS()
+	fs.MkdirAll("/db")
+	open := func() *Db {
+		db, err := NewDbWithOptions("/db", "current-data", false, Options{FS: fs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open()
+	for i := 1; i <= 5; i++ {
+		id, err := db.XAdd("jobs", fmt.Sprintf("job_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != uint64(i) {
+			t.Errorf("Expected ID %d, got %d", i, id)
+		}
+	}
+	if _, err := db.XAdd("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("range", func(t *testing.T) {
+		entries, err := db.XRange("jobs", 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0] != (StreamEntry{2, "job_2"}) || entries[1] != (StreamEntry{3, "job_3"}) {
+			t.Errorf("Unexpected entries %v", entries)
+		}
+		if entries, _ := db.XRange("jobs", 0, 0); len(entries) != 5 {
+			t.Errorf("Expected all the 5 entries, got %v", entries)
+		}
+		if entries, _ := db.XRange("missing", 0, 0); len(entries) != 0 {
+			t.Errorf("Expected no entries of a missing stream, got %v", entries)
+		}
+		if _, err := db.XAdd("bad\x00name", "value"); err != ErrStreamName {
+			t.Errorf("Expected ErrStreamName, got %v", err)
+		}
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		entries, err := db.XReadGroup("jobs", "workers", "c1", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 || entries[0].ID != 1 {
+			t.Fatalf("Unexpected entries %v", entries)
+		}
+		// Nothing is acknowledged until XAck, and the entries stay with
+		// their consumer.
+		if again, _ := db.XReadGroup("jobs", "workers", "c1", 3); len(again) != 3 || again[0].ID != 1 {
+			t.Errorf("Expected the entries to be read again, got %v", again)
+		}
+		if other, _ := db.XReadGroup("jobs", "workers", "c2", 0); len(other) != 2 || other[0].ID != 4 {
+			t.Errorf("Expected the other consumer to get the rest of the entries, got %v", other)
+		}
+
+		if err := db.XAck("jobs", "workers", 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.XAck("jobs", "workers", 1); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := db.XReadGroup("jobs", "workers", "c1", 0); len(entries) != 1 || entries[0].ID != 2 {
+			t.Errorf("Expected the entry not acknowledged, got %v", entries)
+		}
+		if entries, _ := db.XReadGroup("jobs", "audit", "c1", 0); len(entries) != 5 {
+			t.Errorf("Expected a new group to read from the start, got %v", entries)
+		}
+
+		// An entry held for too long is taken by another consumer.
+		g := db.streamGroups[groupKey("jobs", "workers")]
+		g.pending[2] = pendingEntry{"c1", time.Now().Add(-STREAM_CLAIM_TIMEOUT - time.Second)}
+		if entries, _ := db.XReadGroup("jobs", "workers", "c3", 0); len(entries) != 1 || entries[0].ID != 2 {
+			t.Errorf("Expected the entry of c1 to be claimed, got %v", entries)
+		}
+		if entries, _ := db.XReadGroup("jobs", "workers", "c1", 0); len(entries) != 0 {
+			t.Errorf("Expected no entries left for c1, got %v", entries)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		// The last entries are deleted, their IDs are not given out again.
+		if err := db.Delete(streamKey("jobs", 5)); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		db = open()
+		defer db.Close()
+
+		id, err := db.XAdd("jobs", "job_6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 6 {
+			t.Errorf("Expected the IDs to go on from 6, got %d", id)
+		}
+		if entries, _ := db.XReadGroup("jobs", "workers", "c2", 0); len(entries) != 2 || entries[0].ID != 4 || entries[1].ID != 6 {
+			t.Errorf("Expected the pending entries and the new one, got %v", entries)
+		}
+		if entries, _ := db.XReadGroup("jobs", "workers", "c3", 0); len(entries) != 1 || entries[0].ID != 2 {
+			t.Errorf("Expected the pending entry to survive reopening, got %v", entries)
+		}
+	})
+}